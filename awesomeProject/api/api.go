@@ -2,65 +2,176 @@ package api
 
 import (
     "encoding/json"
+    "errors"
+    "fmt"
     "github.com/gorilla/mux"
     _ "github.com/gorilla/mux"
     _ "github.com/lib/pq"
     "log"
+    "net"
     "net/http"
+    "os"
     "time"
 )
 
 // Admin api request
 type Ad struct {
-    UUID       string      `json:"-"`
-    Title      string      `json:"title"`
-    StartAt    time.Time   `json:"startAt"`
-    EndAt      time.Time   `json:"endAt"`
-    Conditions AdCondition `json:"conditions"`
+    UUID         string       `json:"-"`
+    Title        string       `json:"title"`
+    StartAt      time.Time    `json:"startAt"`
+    EndAt        time.Time    `json:"endAt"`
+    Priority     int          `json:"priority"`
+    FrequencyCap FrequencyCap `json:"frequencyCap"`
+    Budget       AdBudget     `json:"budget"`
+    Schedule     AdSchedule   `json:"schedule"`
+    Conditions   AdCondition  `json:"conditions"`
+}
+
+// Recurring weekly schedule inside [startAt, endAt] in an IANA timezone, e.g. weekdays 18:00-23:00 Asia/Taipei.
+// No days means every day, no hours means all day, both empty means always.
+type AdSchedule struct {
+    Timezone string          `json:"timezone"`
+    Days     []string        `json:"days"`
+    Hours    []ScheduleHours `json:"hours"`
+}
+
+// Local time range "HH:MM"-"HH:MM" within one day, end may be "24:00"
+type ScheduleHours struct {
+    Start string `json:"start"`
+    End   string `json:"end"`
+}
+
+// Impression budgets of whole schedule and of each UTC day, 0 means unlimited.
+// Pacing even spreads them over the schedule and the day, asap serves until used up.
+type AdBudget struct {
+    Total  int64  `json:"total"`
+    Daily  int64  `json:"daily"`
+    Pacing string `json:"pacing"`
+}
+
+// Max impressions of one ad per user within period (hour, day or week), 0 means no cap
+type FrequencyCap struct {
+    Max    int    `json:"max"`
+    Period string `json:"period"`
 }
 
 // Admin api request
+// Exclude lists take values out of the included ones, or out of everyone when nothing is included
 type AdCondition struct {
-    AgeStart  int      `json:"ageStart"`
-    AgeEnd    int      `json:"ageEnd"`
-    Gender    []string `json:"Gender"`
-    Countries []string `json:"Country"`
-    Platforms []string `json:"Platform"`
+    AgeStart         int                 `json:"ageStart"`
+    AgeEnd           int                 `json:"ageEnd"`
+    AgeRanges        []AgeRange          `json:"ageRanges"`
+    Gender           []string            `json:"Gender"`
+    Countries        []string            `json:"Country"`
+    Platforms        []string            `json:"Platform"`
+    ExcludeCountries []string            `json:"excludeCountry"`
+    ExcludePlatforms []string            `json:"excludePlatform"`
+    Targeting        map[string][]string `json:"targeting"`
+}
+
+// Inclusive age range, a missing bound is open ended
+type AgeRange struct {
+    Min *int `json:"min,omitempty"`
+    Max *int `json:"max,omitempty"`
 }
 
 // Public api request
 type SearchCondition struct {
-    Offset   int      `json:"-"`
-    Limit    int      `json:"-"`
-    Age      []string `json:"age"`
-    Gender   []string `json:"gender"`
-    Country  []string `json:"country"`
-    Platform []string `json:"platform"`
+    Offset    int                 `json:"-"`
+    Limit     int                 `json:"-"`
+    Cursor    *searchCursor       `json:"-"`
+    Sort      string              `json:"-"`
+    UserID    string              `json:"-"`
+    //Fill missing country from client IP and platform from User-Agent
+    Infer     bool                `json:"-"`
+    Age       []string            `json:"age"`
+    Gender    []string            `json:"gender"`
+    Country   []string            `json:"country"`
+    Platform  []string            `json:"platform"`
+    //Values of registered targeting dimensions by name
+    Targeting map[string][]string `json:"targeting,omitempty"`
 }
 
 // Public api response
+type SearchResponse struct {
+    Items      []SearchResult    `json:"items"`
+    Total      int               `json:"total"`
+    Offset     int               `json:"offset"`
+    Limit      int               `json:"limit"`
+    HasMore    bool              `json:"hasMore"`
+    NextCursor string            `json:"nextCursor,omitempty"`
+    //Condition values inferred from the request, by param name
+    Inferred   map[string]string `json:"inferred,omitempty"`
+
+    //HTTP caching of response, not encoded
+    generation int64
+    expireAt   time.Time
+    volatile   bool
+    //Matched ads came from cache or serving index instead of the database
+    cached     bool
+}
+
+// Public api response item, token is sent back to impression and click tracking
 type SearchResult struct {
     Title string    `json:"title"`
     EndAt time.Time `json:"endAt"`
+    Token string    `json:"token,omitempty"`
 }
 
 func Main() {
     //Init DB,Redis
     setConnections()
 
+    //Country inference of public api
+    if geoIPPath != "" {
+        err := loadGeoIPDatabase(geoIPPath)
+        if err != nil {
+            log.Fatal("Cannot load GeoIP database: ", err)
+        }
+    }
+
+    //Follow ad changes, public api is served from memory when AD_SERVING_INDEX is set
+    startChangeFeed(os.Getenv("AD_SERVING_INDEX") != "")
+
     //Register api handler
-    r := mux.NewRouter()
-    r.HandleFunc("/api/v1/ad", adminAPI).Methods("POST")
-    r.HandleFunc("/api/v1/ad", publicAPI).Methods("GET")
+    r := newRouter()
+
+    //Write tracking events in batches
+    go runStatsWriter(statsFlushInterval)
+
+    //Drop change feed rows older than retention
+    go runChangePruner(time.Hour)
 
     //Clear cache
     clearSearchHistory()
 
+    //Typed rpc for internal services, opt in by AD_GRPC_PORT
+    if grpcPort > 0 {
+        lis, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
+        if err != nil {
+            log.Fatal("Cannot listen for grpc: ", err)
+        }
+        go serveGRPC(lis)
+    }
+
     //Start Server
     println("Server started on port 8080 ", getNowTime().String())
     log.Fatal(http.ListenAndServe(":8080", r))
 }
 
+// Routes of http api, every route is documented in the OpenAPI document
+func newRouter() *mux.Router {
+    r := mux.NewRouter()
+    v1 := r.PathPrefix("/api/v1").Subrouter()
+    v1.Use(deprecateV1)
+    registerRoutes(v1)
+    v2 := r.PathPrefix("/api/v2").Subrouter()
+    v2.Use(useV2)
+    registerRoutes(v2)
+    r.HandleFunc("/openapi.json", openAPIHandler).Methods("GET")
+    return r
+}
+
 func adminAPI(w http.ResponseWriter, r *http.Request) {
 
     //For api test
@@ -73,36 +184,66 @@ func adminAPI(w http.ResponseWriter, r *http.Request) {
     }
 
     //JSON format check
-    var ad Ad
-    err := json.NewDecoder(r.Body).Decode(&ad)
+    ad, err := decodeAd(w, r)
+    var bodyErr *requestBodyError
+    if errors.As(err, &bodyErr) {
+        http.Error(w, err.Error(), bodyErr.status)
+        return
+    }
     if err != nil {
         http.Error(w, "Failed to decode JSON request body "+err.Error(), http.StatusBadRequest)
         return
     }
 
+    //Validate and insert Ad into storage
+    _, err = createAd(ad)
+    var invalidErr *invalidAdError
+    if errors.As(err, &invalidErr) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    var quotaErr *quotaError
+    if errors.As(err, &quotaErr) {
+        http.Error(w, "Quota exceeded: "+err.Error(), http.StatusConflict)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Database error "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    //Response body
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]string{"message": "Successfully added your ad!"})
+}
+
+// Validate and store a new ad, shared by admin api and grpc service. Returns id of the ad.
+func createAd(ad Ad) (string, error) {
+
+    //Country groups and alpha-3 codes to alpha-2 codes
+    err := expandAdCountries(&ad.Conditions)
+    if err != nil {
+        return "", &invalidAdError{err}
+    }
+
     //JSON value check
     err = validateAd(ad)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
+        return "", &invalidAdError{err}
     }
 
     //Insert Ad into storage
-    err = saveAd(ad)
+    id, err := saveAd(ad)
     if err != nil {
-        http.Error(w, "Database error "+err.Error(), http.StatusInternalServerError)
-        return
+        return "", err
     }
 
     //Clear cache
     if ad.StartAt.Before(getNowTime()) && ad.EndAt.After(getNowTime()) {
         clearSearchHistory()
     }
-
-    //Response body
-    w.Header().Set("Content-Type", "application/json")
-    w.WriteHeader(http.StatusCreated)
-    json.NewEncoder(w).Encode(map[string]string{"message": "Successfully added your ad!"})
+    return id, nil
 }
 
 func publicAPI(w http.ResponseWriter, r *http.Request) {
@@ -117,20 +258,63 @@ func publicAPI(w http.ResponseWriter, r *http.Request) {
     }
 
     //Validate URL param and assign default value
+    err := checkSearchParams(r)
+    if err != nil {
+        http.Error(w, "Invalid param: "+err.Error(), http.StatusBadRequest)
+        return
+    }
     condition, err := validateSearchParamAndAssignDefaultVal(r)
     if err != nil {
         http.Error(w, "Invalid param: "+err.Error(), http.StatusBadRequest)
         return
     }
 
+    //Opt-in country and platform inference
+    var inferred map[string]string
+    if condition.Infer {
+        inferred = inferSearchCondition(r, &condition)
+    }
+
+    //Anonymous pages share tracking tokens, each response gets its own serve token to count them once
+    if condition.UserID == "" {
+        w.Header().Set(serveTokenHeader, newServeToken(getNowTime()))
+    }
+
+    //Pre-serialized page skips search and encoding, on miss the generation it was read with is reused
+    generation := unknownGeneration
+    if isPageCacheable(condition) {
+        page, pageGeneration, ok := getCachedPage(condition, inferred)
+        if ok {
+            w.Header().Set("X-Cache", "HIT")
+            writeEncodedPage(w, r, condition, &page)
+            return
+        }
+        generation = pageGeneration
+    }
+
     //Find Ad matches search conditions
-    ads, err := getAdsByConditions(condition)
+    now := getNowTime()
+    found, err := findSearchPage(condition, generation, nil, now)
     if err != nil {
         http.Error(w, "Invalid condition: "+err.Error(), http.StatusBadRequest)
         return
     }
+    found.shared = condition.UserID == ""
+    serveSearchPages([]*searchPage{&found}, now)
+    response := found.response
+    response.Inferred = inferred
 
-    //Response body
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{"items": ads})
+    //Reported by load tests as cache hit ratio
+    if response.cached {
+        w.Header().Set("X-Cache", "HIT")
+    } else {
+        w.Header().Set("X-Cache", "MISS")
+    }
+
+    //Response body, clients holding the same body get 304
+    page := encodePage(response)
+    if isPageCacheable(condition) {
+        saveCachedPage(condition, inferred, response.generation, &page)
+    }
+    writeEncodedPage(w, r, condition, &page)
 }
@@ -1,16 +1,88 @@
 package api
 
 import (
+	"awesomeProject/api/adpb"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 //Note:please clear DB before testing
 
+// Tracking tokens depend on generated uuids, check they exist and drop them before comparing bodies
+func stripTokens(t *testing.T, body []byte) string {
+	var response SearchResponse
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		t.Fatalf("failed to decode response body: %v", err)
+	}
+	for i := range response.Items {
+		if response.Items[i].Token == "" {
+			t.Errorf("missing tracking token in item %v", i)
+		}
+		response.Items[i].Token = ""
+	}
+	stripped, _ := json.Marshal(response)
+	return string(stripped)
+}
+
+// Redis stand-in for tests of cache and counter code, the previous client is restored when the test ends
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	server := miniredis.RunT(t)
+	previous := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = previous
+	})
+	return server
+}
+
+// Postgres stand-in for tests of feed code, statements must match exactly and all expected ones must run
+func useTestDB(t *testing.T) sqlmock.Sqlmock {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := dbClient
+	dbClient = db
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+		dbClient = previous
+	})
+	return mock
+}
+
 /*
 Admin api good case 1
 */
@@ -22,7 +94,7 @@ func TestCreateAdHandler(t *testing.T) {
 			"conditions":{
 				"ageStart": 20,
 				"ageEnd": 30,
-				"Country:":["TW", "JP"],
+				"Country":["TW", "JP"],
 				"Platform":["android", "ios"]
 				}
 			}`
@@ -30,6 +102,7 @@ func TestCreateAdHandler(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(adminAPI)
 
@@ -60,6 +133,7 @@ func TestCreateAdHandler2(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(adminAPI)
 
@@ -85,6 +159,7 @@ func TestCreateAdHandler3(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(adminAPI)
 
@@ -112,6 +187,7 @@ func TestCreateAdHandler4(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(adminAPI)
 
@@ -139,6 +215,7 @@ func TestCreateAdHandler5(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(adminAPI)
 	handler.ServeHTTP(rr, req)
@@ -166,8 +243,8 @@ func TestGetAdsHandler1(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to read response body: %v", err)
 	}
-	expectedResponseBody := `{"items":[{"title":"Good case 1","endAt":"2024-12-31T16:00:00Z"},{"title":"Good case 2","endAt":"2024-12-31T16:00:00Z"}]}`
-	if strings.TrimSpace(string(responseBody)) != strings.TrimSpace(expectedResponseBody) {
+	expectedResponseBody := `{"items":[{"title":"Good case 1","endAt":"2024-12-31T16:00:00Z"},{"title":"Good case 2","endAt":"2024-12-31T16:00:00Z"}],"total":2,"offset":0,"limit":5,"hasMore":false}`
+	if stripTokens(t, responseBody) != expectedResponseBody {
 		t.Errorf("unexpected response body: got %v want %v", string(responseBody), expectedResponseBody)
 	}
 }
@@ -190,9 +267,21 @@ func TestGetAdsHandler2(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to read response body: %v", err)
 	}
-	expectedResponseBody := `{"items":[{"title":"Good case 1","endAt":"2024-12-31T16:00:00Z"}]}`
-	if strings.TrimSpace(string(responseBody)) != strings.TrimSpace(expectedResponseBody) {
-		t.Errorf("unexpected response body: got %v want %v", string(responseBody), expectedResponseBody)
+	var response SearchResponse
+	err = json.Unmarshal(responseBody, &response)
+	if err != nil {
+		t.Fatalf("failed to decode response body: %v", err)
+	}
+	expectedItems := `[{"title":"Good case 1","endAt":"2024-12-31T16:00:00Z"}]`
+	for i := range response.Items {
+		response.Items[i].Token = ""
+	}
+	items, _ := json.Marshal(response.Items)
+	if string(items) != expectedItems {
+		t.Errorf("unexpected response items: got %v want %v", string(items), expectedItems)
+	}
+	if response.Total != 2 || response.Offset != 0 || response.Limit != 1 || !response.HasMore || response.NextCursor == "" {
+		t.Errorf("unexpected pagination metadata: %+v", response)
 	}
 }
 
@@ -214,8 +303,8 @@ func TestGetAdsHandler3(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to read response body: %v", err)
 	}
-	expectedResponseBody := `{"items":[{"title":"Good case 1","endAt":"2024-12-31T16:00:00Z"},{"title":"Good case 2","endAt":"2024-12-31T16:00:00Z"}]}`
-	if strings.TrimSpace(string(responseBody)) != strings.TrimSpace(expectedResponseBody) {
+	expectedResponseBody := `{"items":[{"title":"Good case 1","endAt":"2024-12-31T16:00:00Z"},{"title":"Good case 2","endAt":"2024-12-31T16:00:00Z"}],"total":2,"offset":0,"limit":5,"hasMore":false}`
+	if stripTokens(t, responseBody) != expectedResponseBody {
 		t.Errorf("unexpected response body: got %v want %v", string(responseBody), expectedResponseBody)
 	}
 }
@@ -267,3 +356,1783 @@ func TestGetAdsHandler5(t *testing.T) {
 		t.Errorf("unexpected response body: got %v want %v", string(responseBody), expectedResponseBody)
 	}
 }
+
+/*
+public api good case 4: offset past the end returns empty items
+*/
+func TestGetAdsHandler6(t *testing.T) {
+	req, err := http.NewRequest("GET", "/api/v1/ad?offset=100", nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	publicAPI(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+	responseBody, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+	expectedResponseBody := `{"items":[],"total":2,"offset":100,"limit":5,"hasMore":false}`
+	if strings.TrimSpace(string(responseBody)) != strings.TrimSpace(expectedResponseBody) {
+		t.Errorf("unexpected response body: got %v want %v", string(responseBody), expectedResponseBody)
+	}
+}
+
+/*
+Active ad quota: peak of overlapping ads inside new ad's window
+*/
+func TestPeakConcurrentAds(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	intervals := [][2]time.Time{
+		{day(1), day(10)},
+		{day(5), day(6)},
+		{day(6), day(8)},
+		{day(20), day(25)},
+	}
+	if peak := peakConcurrentAds(intervals, day(1), day(31)); peak != 3 {
+		t.Errorf("unexpected peak: got %v want %v", peak, 3)
+	}
+	if peak := peakConcurrentAds(intervals, day(7), day(21)); peak != 2 {
+		t.Errorf("unexpected peak: got %v want %v", peak, 2)
+	}
+	if peak := peakConcurrentAds(intervals, day(11), day(19)); peak != 0 {
+		t.Errorf("unexpected peak: got %v want %v", peak, 0)
+	}
+}
+
+/*
+Serving index: intersection of targeting fields, sorted by endAt
+*/
+func TestAdIndexSearch(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	start := now.Add(-time.Hour)
+	index := newAdIndex()
+	index.build([]Ad{
+		{UUID: "1", Title: "TW android", StartAt: start, EndAt: now.Add(3 * time.Hour), Conditions: AdCondition{Countries: []string{"TW"}, Platforms: []string{"android"}}},
+		{UUID: "2", Title: "everyone", StartAt: start, EndAt: now.Add(2 * time.Hour)},
+		{UUID: "3", Title: "JP 20-30", StartAt: start, EndAt: now.Add(time.Hour), Conditions: AdCondition{AgeStart: 20, AgeEnd: 30, Countries: []string{"JP"}}},
+		{UUID: "4", Title: "expired", StartAt: start, EndAt: now.Add(-time.Minute)},
+	})
+
+	titles := func(ads []Ad) string {
+		var result []string
+		for _, ad := range ads {
+			result = append(result, ad.Title)
+		}
+		return strings.Join(result, ",")
+	}
+	cases := []struct {
+		condition SearchCondition
+		expected  string
+	}{
+		{SearchCondition{}, "JP 20-30,everyone,TW android"},
+		{SearchCondition{Country: []string{"TW"}}, "everyone,TW android"},
+		{SearchCondition{Country: []string{"TW", "JP"}, Age: []string{"25"}}, "JP 20-30,everyone,TW android"},
+		{SearchCondition{Country: []string{"JP"}, Age: []string{"31"}}, "everyone"},
+		{SearchCondition{Platform: []string{"ios"}, Gender: []string{"F"}}, "JP 20-30,everyone"},
+	}
+	for _, c := range cases {
+		ads, _ := index.search(c.condition, now)
+		if got := titles(ads); got != c.expected {
+			t.Errorf("unexpected search result for %+v: got %v want %v", c.condition, got, c.expected)
+		}
+	}
+}
+
+/*
+Serving index: changes re-index only the changed ad, reuse its slot and bump generation once
+*/
+func TestAdIndexRefresh(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	start := now.Add(-time.Hour)
+	index := newAdIndex()
+	for i := 0; i < 64; i++ {
+		index.loaded[strconv.Itoa(i)] = Ad{UUID: strconv.Itoa(i), Title: "JP", StartAt: start, EndAt: now.Add(time.Hour), Conditions: AdCondition{Countries: []string{"JP"}}}
+	}
+	index.rebuild(now)
+
+	titles := func(condition SearchCondition) string {
+		ads, _ := index.search(condition, now)
+		var result []string
+		for _, ad := range ads {
+			result = append(result, ad.Title)
+		}
+		return strings.Join(result, ",")
+	}
+	change := func(ad Ad, found bool) {
+		t.Helper()
+		generation := index.generation
+		if found {
+			index.loaded[ad.UUID] = ad
+		} else {
+			delete(index.loaded, ad.UUID)
+		}
+		index.refresh(ad.UUID, now)
+		if index.generation != generation+1 {
+			t.Errorf("unexpected generation after changing %s: got %v want %v", ad.UUID, index.generation, generation+1)
+		}
+	}
+
+	//Full index grows, the changed ad moves out of JP and is sorted by endAt
+	change(Ad{UUID: "new", Title: "TW", StartAt: start, EndAt: now.Add(time.Minute), Conditions: AdCondition{Countries: []string{"TW"}}}, true)
+	if got := titles(SearchCondition{Country: []string{"TW"}}); got != "TW" {
+		t.Errorf("unexpected TW ads: got %v", got)
+	}
+	change(Ad{UUID: "0", Title: "not JP", StartAt: start, EndAt: now.Add(time.Second), Conditions: AdCondition{ExcludeCountries: []string{"JP"}}}, true)
+	if got := titles(SearchCondition{Country: []string{"TW"}}); got != "not JP,TW" {
+		t.Errorf("unexpected TW ads: got %v", got)
+	}
+	if ads, _ := index.search(SearchCondition{Country: []string{"JP"}}, now); len(ads) != 63 {
+		t.Errorf("unexpected JP ads: got %v want %v", len(ads), 63)
+	}
+
+	//Deleted ad frees its slot for the next one
+	change(Ad{UUID: "new"}, false)
+	slot := index.slots["1"]
+	change(Ad{UUID: "1"}, false)
+	change(Ad{UUID: "later", Title: "later", StartAt: start, EndAt: now.Add(time.Minute)}, true)
+	if index.slots["later"] != slot {
+		t.Errorf("unexpected slot: got %v want %v", index.slots["later"], slot)
+	}
+	if got := titles(SearchCondition{Country: []string{"TW"}}); got != "not JP,later" {
+		t.Errorf("unexpected TW ads: got %v", got)
+	}
+
+	//Expiring moves ads out without touching the rest
+	generation := index.generation
+	index.expire(now.Add(2 * time.Minute))
+	if _, ok := index.slots["0"]; ok {
+		t.Errorf("expired ad still indexed")
+	}
+	if index.generation != generation+2 || len(index.slots) != 62 {
+		t.Errorf("unexpected index after expiry: generation %v ads %v", index.generation-generation, len(index.slots))
+	}
+}
+
+/*
+Cursor pagination: signed cursor seeks by (endAt, uuid) when ads changed
+*/
+func TestCursorSeek(t *testing.T) {
+	endAt := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	ads := []Ad{
+		{UUID: "a", EndAt: endAt},
+		{UUID: "c", EndAt: endAt},
+		{UUID: "b", EndAt: endAt.Add(time.Hour)},
+	}
+	cursor, err := decodeCursor(encodeCursor(newSearchCursor(1, 1, defaultRanking, ads[0])))
+	if err != nil {
+		t.Fatalf("failed to decode cursor: %v", err)
+	}
+	if start := seekCursor(ads, cursor, 1, ""); start != 1 {
+		t.Errorf("unexpected start for same generation: got %v want %v", start, 1)
+	}
+
+	//"a" removed and "b" inserted before "c"
+	changed := []Ad{
+		{UUID: "b", EndAt: endAt},
+		{UUID: "c", EndAt: endAt},
+	}
+	if start := seekCursor(changed, cursor, 2, ""); start != 0 {
+		t.Errorf("unexpected start for new generation: got %v want %v", start, 0)
+	}
+
+	token := encodeCursor(cursor)
+	if _, err := decodeCursor(token[:len(token)-2] + "xx"); err == nil {
+		t.Errorf("expected tampered cursor to be rejected")
+	}
+}
+
+/*
+Ranking: strategies reorder shared candidates, shuffle is stable per user
+*/
+func TestRankAds(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	var ads []Ad
+	for i := 0; i < 20; i++ {
+		ads = append(ads, Ad{UUID: fmt.Sprintf("%02d", i), StartAt: now.Add(time.Duration(i) * time.Hour), EndAt: now.Add(time.Duration(100-i) * time.Hour)})
+	}
+	ids := func(ads []Ad) string {
+		var result []string
+		for _, ad := range ads {
+			result = append(result, ad.UUID)
+		}
+		return strings.Join(result, ",")
+	}
+
+	newest := rankAds(ads, "newest", "")
+	if newest[0].UUID != "19" || newest[19].UUID != "00" {
+		t.Errorf("unexpected newest order: %v", ids(newest))
+	}
+	if ads[0].UUID != "00" {
+		t.Errorf("candidates modified by ranking: %v", ids(ads))
+	}
+
+	first := rankAds(ads, "shuffle", "user-1")
+	if ids(first) != ids(rankAds(ads, "shuffle", "user-1")) {
+		t.Errorf("shuffle is not stable for the same user")
+	}
+	if ids(first) == ids(rankAds(ads, "shuffle", "user-2")) {
+		t.Errorf("shuffle is the same for different users")
+	}
+
+	//Cursor seeks in shuffled order even when the last ad is gone
+	cursor := newSearchCursor(1, 5, "shuffle", first[4])
+	if start := seekCursor(first, cursor, 2, "user-1"); start != 5 {
+		t.Errorf("unexpected start: got %v want %v", start, 5)
+	}
+	withoutLast := append(append([]Ad{}, first[:4]...), first[5:]...)
+	if start := seekCursor(withoutLast, cursor, 2, "user-1"); start != 4 {
+		t.Errorf("unexpected start without last ad: got %v want %v", start, 4)
+	}
+}
+
+/*
+Ranking: priority orders by bid, weighted sampling favours high bids without starving low ones
+*/
+func TestRankAdsByPriority(t *testing.T) {
+	endAt := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	ads := []Ad{
+		{UUID: "low", EndAt: endAt, Priority: 0},
+		{UUID: "high", EndAt: endAt, Priority: 99},
+		{UUID: "mid", EndAt: endAt, Priority: 9},
+	}
+	ranked := rankAds(ads, "priority", "")
+	if ranked[0].UUID != "high" || ranked[1].UUID != "mid" || ranked[2].UUID != "low" {
+		t.Errorf("unexpected priority order: %v %v %v", ranked[0].UUID, ranked[1].UUID, ranked[2].UUID)
+	}
+
+	firsts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		firsts[rankAds(ads, "weighted", fmt.Sprint(i))[0].UUID]++
+	}
+	if firsts["high"] < firsts["mid"] || firsts["mid"] < firsts["low"] || firsts["low"] == 0 {
+		t.Errorf("unexpected weighted picks: %v", firsts)
+	}
+}
+
+/*
+Frequency cap: period windows and local fallback counters
+*/
+func TestFrequencyWindow(t *testing.T) {
+	//Wednesday
+	now := time.Date(2024, 3, 6, 15, 30, 0, 0, time.UTC)
+	cases := map[string][2]time.Time{
+		"hour": {time.Date(2024, 3, 6, 15, 0, 0, 0, time.UTC), time.Date(2024, 3, 6, 16, 0, 0, 0, time.UTC)},
+		"day":  {time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC)},
+		"week": {time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+	}
+	for period, expected := range cases {
+		start, end := frequencyWindow(period, now)
+		if !start.Equal(expected[0]) || !end.Equal(expected[1]) {
+			t.Errorf("unexpected %v window: got %v - %v want %v - %v", period, start, end, expected[0], expected[1])
+		}
+	}
+
+	counters := &localCounters{counts: map[string]int{}, expireAt: map[string]time.Time{}}
+	counters.incr("key", now.Add(time.Minute), now)
+	counters.incr("key", now.Add(time.Minute), now)
+	if count := counters.get("key", now); count != 2 {
+		t.Errorf("unexpected count: got %v want %v", count, 2)
+	}
+	if count := counters.get("key", now.Add(time.Hour)); count != 0 {
+		t.Errorf("unexpected count after expiry: got %v want %v", count, 0)
+	}
+}
+
+/*
+Tracking api: signed token is accepted only for its own ad, tokens count once and shared tokens once per serve token
+*/
+func TestTrackingHandler(t *testing.T) {
+	useTestRedis(t)
+	ad := Ad{UUID: "6f1c1a40-8d3f-4a37-9a51-0c4c0d3b2f11", EndAt: getNowTime().Add(time.Hour)}
+	token := newTrackingToken(ad, "user-1")
+	if token == newTrackingToken(ad, "user-1") || newTrackingToken(ad, "") == newTrackingToken(ad, "") {
+		t.Errorf("expected a new token per serve")
+	}
+	shared := newSharedTrackingToken(ad)
+	if shared != newSharedTrackingToken(ad) {
+		t.Errorf("expected same shared token, pages with it are cached")
+	}
+	serve, otherServe := newServeToken(getNowTime()), newServeToken(getNowTime())
+
+	cases := []struct {
+		adID     string
+		token    string
+		serve    string
+		expected int
+		queued   bool
+	}{
+		{ad.UUID, token, "", http.StatusAccepted, true},
+		{ad.UUID, token, "", http.StatusAccepted, false},
+		{"5b0e4a52-3a55-4f6b-8d61-2f0b7c1a9e22", token, "", http.StatusBadRequest, false},
+		{ad.UUID, token + "x", "", http.StatusBadRequest, false},
+		{ad.UUID, "", "", http.StatusBadRequest, false},
+		{ad.UUID, shared, "", http.StatusBadRequest, false},
+		{ad.UUID, shared, serve + "x", http.StatusBadRequest, false},
+		{ad.UUID, shared, serve, http.StatusAccepted, true},
+		{ad.UUID, shared, serve, http.StatusAccepted, false},
+		{ad.UUID, shared, otherServe, http.StatusAccepted, true},
+	}
+	for i, c := range cases {
+		req, err := http.NewRequest("POST", "/api/v1/ad/"+c.adID+"/click", bytes.NewBufferString(`{"token":"`+c.token+`","serve":"`+c.serve+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req = mux.SetURLVars(req, map[string]string{"id": c.adID})
+		rr := httptest.NewRecorder()
+		trackingAPI(clickEvent)(rr, req)
+		if status := rr.Code; status != c.expected {
+			t.Errorf("case %d: handler returned wrong status code: got %v want %v", i, status, c.expected)
+		}
+
+		select {
+		case e := <-statsEvents:
+			if !c.queued || e.adID != ad.UUID || e.event != clickEvent {
+				t.Errorf("case %d: unexpected stats event: %+v", i, e)
+			}
+		default:
+			if c.queued {
+				t.Errorf("case %d: click was not queued", i)
+			}
+		}
+	}
+}
+
+/*
+Budget: used up budgets and even pacing stop delivery
+*/
+func TestWithinBudget(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	ad := Ad{StartAt: start, EndAt: start.AddDate(0, 0, 10), Budget: AdBudget{Total: 1000, Daily: 200, Pacing: "asap"}}
+	noon := start.AddDate(0, 0, 5).Add(12 * time.Hour)
+
+	if !withinBudget(ad, 999, 199, noon) {
+		t.Errorf("expected ad with remaining budget to be served")
+	}
+	if withinBudget(ad, 1000, 0, noon) {
+		t.Errorf("expected ad with used up total budget to stop")
+	}
+	if withinBudget(ad, 0, 200, noon) {
+		t.Errorf("expected ad with used up daily budget to stop")
+	}
+
+	//Half way through schedule and day
+	ad.Budget.Pacing = "even"
+	if !withinBudget(ad, 549, 100, noon) {
+		t.Errorf("expected ad on pace to be served")
+	}
+	if withinBudget(ad, 551, 0, noon) {
+		t.Errorf("expected ad ahead of total pace to be throttled")
+	}
+	if withinBudget(ad, 0, 101, noon) {
+		t.Errorf("expected ad ahead of daily pace to be throttled")
+	}
+}
+
+/*
+Schedule: weekday evening window in Taipei time and next boundary
+*/
+func TestScheduleActiveAt(t *testing.T) {
+	schedule := AdSchedule{
+		Timezone: "Asia/Taipei",
+		Days:     []string{"Mon", "Tue", "Wed", "Thu", "Fri"},
+		Hours:    []ScheduleHours{{Start: "18:00", End: "23:00"}},
+	}
+	if err := validateSchedule(schedule); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	cases := []struct {
+		now    time.Time
+		active bool
+		next   time.Time
+	}{
+		//Friday 19:00 Taipei
+		{time.Date(2024, 3, 8, 11, 0, 0, 0, time.UTC), true, time.Date(2024, 3, 8, 15, 0, 0, 0, time.UTC)},
+		//Friday 23:30 Taipei, next window is Monday 18:00
+		{time.Date(2024, 3, 8, 15, 30, 0, 0, time.UTC), false, time.Date(2024, 3, 11, 10, 0, 0, 0, time.UTC)},
+		//Saturday 19:00 Taipei
+		{time.Date(2024, 3, 9, 11, 0, 0, 0, time.UTC), false, time.Date(2024, 3, 11, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		active, next := schedule.activeAt(c.now)
+		if active != c.active || !next.Equal(c.next) {
+			t.Errorf("unexpected schedule state at %v: got %v %v want %v %v", c.now, active, next.UTC(), c.active, c.next)
+		}
+	}
+
+	invalid := []AdSchedule{
+		{Days: []string{"Mon"}},
+		{Timezone: "Mars/Olympus", Days: []string{"Mon"}},
+		{Timezone: "UTC", Days: []string{"Monday"}},
+		{Timezone: "UTC", Hours: []ScheduleHours{{Start: "23:00", End: "01:00"}}},
+	}
+	for _, s := range invalid {
+		if validateSchedule(s) == nil {
+			t.Errorf("expected invalid schedule: %+v", s)
+		}
+	}
+}
+
+/*
+Age ranges: disjoint and open ended ranges, overlap is rejected
+*/
+func TestAgeRanges(t *testing.T) {
+	age := func(value int) *int { return &value }
+	ranges := []AgeRange{{Min: age(13), Max: age(17)}, {Min: age(50)}}
+	if err := validateAgeRanges(ranges); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	index := newAdIndex()
+	index.build([]Ad{{UUID: "1", StartAt: now, EndAt: now.Add(time.Hour), Conditions: AdCondition{AgeRanges: ranges}}})
+	for value, expected := range map[string]int{"13": 1, "17": 1, "30": 0, "50": 1, "100": 1} {
+		ads, _ := index.search(SearchCondition{Age: []string{value}}, now)
+		if len(ads) != expected {
+			t.Errorf("unexpected match for age %v: got %v want %v", value, len(ads), expected)
+		}
+	}
+
+	invalid := [][]AgeRange{
+		{{}},
+		{{Min: age(0)}},
+		{{Min: age(30), Max: age(20)}},
+		{{Max: age(20)}, {Min: age(20)}},
+	}
+	for _, r := range invalid {
+		if validateAgeRanges(r) == nil {
+			t.Errorf("expected invalid age ranges: %+v", r)
+		}
+	}
+}
+
+/*
+Exclusion targeting: excluded values are taken out of included ones or everyone
+*/
+func TestExclusionTargeting(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	index := newAdIndex()
+	index.build([]Ad{
+		{UUID: "1", StartAt: now, EndAt: now.Add(time.Hour), Conditions: AdCondition{ExcludeCountries: []string{"CN", "RU"}}},
+		{UUID: "2", StartAt: now, EndAt: now.Add(2 * time.Hour), Conditions: AdCondition{Platforms: []string{"ios", "web"}, ExcludePlatforms: []string{"android"}}},
+		{UUID: "3", StartAt: now, EndAt: now.Add(3 * time.Hour), Conditions: AdCondition{ExcludePlatforms: []string{"web"}}},
+	})
+	cases := []struct {
+		condition SearchCondition
+		expected  int
+	}{
+		{SearchCondition{Country: []string{"CN"}}, 2},
+		{SearchCondition{Country: []string{"CN", "TW"}}, 3},
+		{SearchCondition{Platform: []string{"web"}}, 2},
+		{SearchCondition{Platform: []string{"android"}}, 2},
+	}
+	for _, c := range cases {
+		ads, _ := index.search(c.condition, now)
+		if len(ads) != c.expected {
+			t.Errorf("unexpected match count for %+v: got %v want %v", c.condition, len(ads), c.expected)
+		}
+	}
+
+	ad := Ad{Title: "Bad", StartAt: now, EndAt: now.Add(time.Hour), Conditions: AdCondition{Countries: []string{"TW"}, ExcludeCountries: []string{"TW"}}}
+	if validateAd(ad) == nil {
+		t.Errorf("expected country both included and excluded to be rejected")
+	}
+}
+
+/*
+Targeting dimensions: enum, semver constraints and key/value tags
+*/
+func TestMatchTargeting(t *testing.T) {
+	ad := normalizeTargeting(map[string][]string{
+		"language":   {"ZH", "en"},
+		"appVersion": {">=5.2", "<6"},
+		"tag":        {"interest=sports", "interest=music"},
+	})
+	if err := validateTargeting(ad, false); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	cases := []struct {
+		query    map[string][]string
+		expected bool
+	}{
+		{map[string][]string{}, true},
+		{map[string][]string{"language": {"zh"}}, true},
+		{map[string][]string{"language": {"ja"}}, false},
+		{map[string][]string{"appVersion": {"5.2"}}, true},
+		{map[string][]string{"appVersion": {"5.10.1"}}, true},
+		{map[string][]string{"appVersion": {"6.0"}}, false},
+		{map[string][]string{"osVersion": {"17.1"}}, true},
+		{map[string][]string{"tag": {"interest=music", "gender=x"}}, true},
+		{map[string][]string{"tag": {"interest=cooking"}}, false},
+		{map[string][]string{"tag": {"city=taipei"}}, true},
+	}
+	for _, c := range cases {
+		if got := matchTargeting(ad, normalizeTargeting(c.query)); got != c.expected {
+			t.Errorf("unexpected match for %v: got %v want %v", c.query, got, c.expected)
+		}
+	}
+
+	invalid := []map[string][]string{
+		{"language": {"xx"}},
+		{"appVersion": {">=five"}},
+		{"tag": {"sports"}},
+		{"unknown": {"value"}},
+	}
+	for _, targeting := range invalid {
+		if validateTargeting(targeting, false) == nil {
+			t.Errorf("expected invalid targeting: %v", targeting)
+		}
+	}
+}
+
+/*
+Country groups and alpha-3 codes expand to alpha-2 codes, exclusions remove group members
+*/
+func TestExpandAdCountries(t *testing.T) {
+	for value, expected := range map[string]string{"tw": "TW", "TWN": "TW", "deu": "DE", "US": "US"} {
+		if got, ok := normalizeCountry(value); !ok || got != expected {
+			t.Errorf("unexpected country for %s: got %s want %s", value, got, expected)
+		}
+	}
+	if _, ok := normalizeCountry("NULL"); ok {
+		t.Errorf("expected NULL to be invalid")
+	}
+	if isISO3166("TWN") || isISO3166("tw") || !isISO3166("TW") {
+		t.Errorf("expected only alpha-2 codes to be stored form")
+	}
+
+	condition := AdCondition{Countries: []string{"eu", "JPN", "FR"}, ExcludeCountries: []string{"de"}}
+	if err := expandAdCountries(&condition); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(condition.Countries) != len(builtinCountryGroups["EU"]) || contains(condition.Countries, "DE") || !contains(condition.Countries, "JP") {
+		t.Errorf("unexpected countries: %v", condition.Countries)
+	}
+	if len(condition.ExcludeCountries) != 1 || condition.ExcludeCountries[0] != "DE" {
+		t.Errorf("unexpected excluded countries: %v", condition.ExcludeCountries)
+	}
+
+	conflict := AdCondition{Countries: []string{"DE"}, ExcludeCountries: []string{"de"}}
+	if expandAdCountries(&conflict) == nil {
+		t.Errorf("expected same country included and excluded to be rejected")
+	}
+	empty := AdCondition{Countries: []string{"DE"}, ExcludeCountries: []string{"EU"}}
+	if expandAdCountries(&empty) == nil {
+		t.Errorf("expected exclusion leaving no country to be rejected")
+	}
+
+	group := CountryGroup{Name: "dach", Countries: []string{"DE", "aut", "ch", "DE"}}
+	if err := validateCountryGroup(&group); err != nil || group.Name != "DACH" || len(group.Countries) != 3 {
+		t.Errorf("unexpected group: %v %v", group, err)
+	}
+	for _, name := range []string{"DE", "USA", "EU", "x"} {
+		if validateCountryGroup(&CountryGroup{Name: name, Countries: []string{"DE"}}) == nil {
+			t.Errorf("expected group name %s to be rejected", name)
+		}
+	}
+}
+
+/*
+Country from GeoIP ranges behind trusted proxies, platform from User-Agent
+*/
+func TestInferSearchCondition(t *testing.T) {
+	ranges, err := readGeoIPRanges(strings.NewReader("start_ip,end_ip,country\n1.0.0.0,1.0.0.255,AU\n# comment\n36.224.0.0,36.231.255.255,TWN\n2001:b000::,2001:b01f:ffff:ffff:ffff:ffff:ffff:ffff,TW\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func(ranges []geoIPRange, proxies []netip.Prefix) {
+		geoIPRanges, trustedProxies = ranges, proxies
+	}(geoIPRanges, trustedProxies)
+	geoIPRanges = ranges
+	trustedProxies = parseTrustedProxies("10.0.0.0/8, 192.168.1.1/32, 36.225.1.1/32")
+
+	cases := []struct {
+		remoteAddr string
+		forwarded  string
+		userAgent  string
+		country    string
+		platform   string
+	}{
+		{"36.225.1.2:5000", "", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)", "TW", "web"},
+		{"10.0.0.1:5000", "1.0.0.7, 192.168.1.1", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)", "AU", "ios"},
+		{"10.0.0.1:5000", "36.225.1.2, 8.8.8.8", "Mozilla/5.0 (Linux; Android 14)", "", "android"},
+		{"1.0.0.9:5000", "36.225.1.2", "curl/8.0", "AU", ""},
+		{"36.225.1.1:5000", "1.0.0.7, not-an-ip", "curl/8.0", "", ""},
+		{"[2001:b000::1]:5000", "", "", "TW", ""},
+		{"[::ffff:1.0.0.1]:5000", "", "", "AU", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/v1/ad?infer=true", nil)
+		r.RemoteAddr = c.remoteAddr
+		r.Header.Set("User-Agent", c.userAgent)
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		var condition SearchCondition
+		inferred := inferSearchCondition(r, &condition)
+		if inferred["country"] != c.country || inferred["platform"] != c.platform {
+			t.Errorf("unexpected inference for %s %s: %v", c.remoteAddr, c.forwarded, inferred)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/ad?infer=true&country=JP", nil)
+	r.RemoteAddr = "1.0.0.1:5000"
+	condition := SearchCondition{Country: []string{"JP"}}
+	if inferred := inferSearchCondition(r, &condition); inferred["country"] != "" || condition.Country[0] != "JP" {
+		t.Errorf("expected explicit country to be kept: %v", condition.Country)
+	}
+
+	if _, err := readGeoIPRanges(strings.NewReader("1.0.0.255,1.0.0.0,AU\n")); err == nil {
+		t.Errorf("expected reversed range to be rejected")
+	}
+}
+
+/*
+JSON search body is validated like query params, batch placements need unique ids
+*/
+func TestValidateSearchRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/ad?offset=2&limit=10&age=30&gender=F&country=twn&platform=ios&language=EN&deviceId=d1&sort=priority", nil)
+	fromQuery, err := validateSearchParamAndAssignDefaultVal(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var body searchBody
+	err = json.Unmarshal([]byte(`{"offset":2,"limit":10,"age":[30],"gender":["F"],"country":["TW"],"platform":["ios"],"targeting":{"language":["en"]},"deviceId":"d1","sort":"priority"}`), &body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fromBody, err := validateSearchRequest(body.searchRequest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(fromQuery) != fmt.Sprint(fromBody) {
+		t.Errorf("query and body conditions differ: %v %v", fromQuery, fromBody)
+	}
+
+	defaults, err := validateSearchRequest(searchRequest{})
+	if err != nil || defaults.Offset != 0 || defaults.Limit != 5 || defaults.Sort != defaultRanking {
+		t.Errorf("unexpected defaults: %v %v", defaults, err)
+	}
+	limit := 101
+	for _, request := range []searchRequest{{Limit: &limit}, {Age: []int{0}}, {Country: []string{"NULL"}}, {Targeting: map[string][]string{"language": {"xx"}}}} {
+		if _, err := validateSearchRequest(request); err == nil {
+			t.Errorf("expected invalid request: %v", request)
+		}
+	}
+
+	err = json.Unmarshal([]byte(`{"placements":[{"id":"top","limit":1,"country":["TW"]},{"id":"side","platform":["web"]}]}`), &body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conditions, err := validatePlacements(body.Placements)
+	if err != nil || len(conditions) != 2 || conditions[0].Limit != 1 || conditions[1].Platform[0] != "web" {
+		t.Errorf("unexpected placements: %v %v", conditions, err)
+	}
+	if _, err := validatePlacements([]searchPlacement{{ID: "a"}, {ID: "a"}}); err == nil {
+		t.Errorf("expected duplicate placement ids to be rejected")
+	}
+	if _, err := validatePlacements([]searchPlacement{{ID: "a"}, {ID: "b", searchRequest: searchRequest{Gender: []string{"X"}}}}); err == nil || !strings.Contains(err.Error(), "placements[1]") {
+		t.Errorf("expected invalid placement to be reported: %v", err)
+	}
+}
+
+/*
+Grpc service over an in-process connection, searching the serving index and mapping errors to status codes
+*/
+func TestGRPCService(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	server := newGRPCServer()
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	client := adpb.NewAdServiceClient(conn)
+	ctx := context.Background()
+
+	defer func(index *adIndex) { servingIndex = index }(servingIndex)
+	now := getNowTime()
+	servingIndex = newAdIndex()
+	servingIndex.build([]Ad{
+		{UUID: "1", Title: "TW", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour), Conditions: AdCondition{Countries: []string{"TW"}}},
+		{UUID: "2", Title: "JP", StartAt: now.Add(-time.Hour), EndAt: now.Add(2 * time.Hour), Conditions: AdCondition{Countries: []string{"JP"}}},
+	})
+	limit := int32(1)
+	response, err := client.SearchAds(ctx, &adpb.SearchAdsRequest{Country: []string{"twn"}, Limit: &limit})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.Total != 1 || len(response.Items) != 1 || response.Items[0].Title != "TW" || response.Items[0].Token == "" {
+		t.Errorf("unexpected response: %v", response)
+	}
+
+	zero := int32(0)
+	invalid := []struct {
+		call func() error
+		code codes.Code
+	}{
+		{func() error { _, err := client.SearchAds(ctx, &adpb.SearchAdsRequest{Limit: &zero}); return err }, codes.InvalidArgument},
+		{func() error { _, err := client.CreateAd(ctx, &adpb.CreateAdRequest{}); return err }, codes.InvalidArgument},
+		{func() error {
+			_, err := client.CreateAd(ctx, &adpb.CreateAdRequest{Ad: &adpb.Ad{Title: "invalid gender", Conditions: &adpb.Conditions{Gender: []string{"X"}}}})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.CreateAd(ctx, &adpb.CreateAdRequest{Ad: &adpb.Ad{Title: "no dates"}})
+			return err
+		}, codes.InvalidArgument},
+		{func() error {
+			_, err := client.CreateAd(ctx, &adpb.CreateAdRequest{Ad: &adpb.Ad{Title: "no end", StartAt: timestamppb.New(now)}})
+			return err
+		}, codes.InvalidArgument},
+		{func() error { _, err := client.GetAd(ctx, &adpb.GetAdRequest{Id: "not-a-uuid"}); return err }, codes.InvalidArgument},
+		{func() error { _, err := client.ListAds(ctx, &adpb.ListAdsRequest{PageSize: 5000}); return err }, codes.InvalidArgument},
+	}
+	for i, c := range invalid {
+		if code := status.Code(c.call()); code != c.code {
+			t.Errorf("case %d: unexpected code %v want %v", i, code, c.code)
+		}
+	}
+
+	if err := validateAd(adFromProto(&adpb.Ad{Title: "x"})); err == nil {
+		t.Errorf("expected ad without timestamps to be invalid")
+	}
+	if code := status.Code(grpcError(&quotaError{})); code != codes.ResourceExhausted {
+		t.Errorf("unexpected quota error code: %v", code)
+	}
+
+	min := 20
+	ad := Ad{UUID: "1", Title: "round trip", StartAt: now.Truncate(time.Second), EndAt: now.Add(time.Hour).Truncate(time.Second),
+		Schedule:   AdSchedule{Timezone: "Asia/Taipei", Days: []string{"Mon"}, Hours: []ScheduleHours{{Start: "09:00", End: "18:00"}}},
+		Conditions: AdCondition{AgeRanges: []AgeRange{{Min: &min}}, Countries: []string{"TW"}, Targeting: map[string][]string{"language": {"zh"}}}}
+	if got := adFromProto(adToProto(ad)); fmt.Sprint(got.Conditions.Targeting, got.Schedule, *got.Conditions.AgeRanges[0].Min, got.StartAt.Equal(ad.StartAt)) != fmt.Sprint(ad.Conditions.Targeting, ad.Schedule, min, true) {
+		t.Errorf("unexpected round trip: %v", got)
+	}
+}
+
+// Check decoded JSON value against OpenAPI schema, covers the keywords the generated document uses
+func checkSchema(doc map[string]interface{}, schema map[string]interface{}, value interface{}, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		return checkSchema(doc, doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{}), value, path)
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, option := range oneOf {
+			if checkSchema(doc, option.(map[string]interface{}), value, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s: %d of oneOf schemas match", path, matched)
+		}
+		return nil
+	}
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not allowed", path)
+	}
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", path, name)
+			}
+		}
+		for name, field := range object {
+			if property, ok := properties[name]; ok {
+				if err := checkSchema(doc, property.(map[string]interface{}), field, path+"."+name); err != nil {
+					return err
+				}
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				if err := checkSchema(doc, additional, field, path+"."+name); err != nil {
+					return err
+				}
+			} else if schema["additionalProperties"] == false {
+				return fmt.Errorf("%s: undocumented field %s", path, name)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array", path)
+		}
+		for i, item := range array {
+			if err := checkSchema(doc, schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected string", path)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("%s: expected date-time", path)
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			return fmt.Errorf("%s: expected integer", path)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected number", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean", path)
+		}
+	}
+	return nil
+}
+
+/*
+OpenAPI document covers every route, and real handler responses match its schemas
+*/
+func TestOpenAPIDocument(t *testing.T) {
+	router := newRouter()
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/openapi.json", nil))
+	var doc map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	paths := doc["paths"].(map[string]interface{})
+
+	routed := map[string]bool{}
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			routed[path+" "+strings.ToLower(method)] = true
+			if _, ok := paths[path].(map[string]interface{})[strings.ToLower(method)]; !ok {
+				t.Errorf("route %s %s is not documented", method, path)
+			}
+		}
+		return nil
+	})
+	for path, operations := range paths {
+		for method := range operations.(map[string]interface{}) {
+			if !routed[path+" "+method] {
+				t.Errorf("documented %s %s is not routed", method, path)
+			}
+		}
+	}
+
+	defer func(index *adIndex) { servingIndex = index }(servingIndex)
+	now := getNowTime()
+	servingIndex = newAdIndex()
+	servingIndex.build([]Ad{
+		{UUID: "1", Title: "first", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour)},
+		{UUID: "2", Title: "second", StartAt: now.Add(-time.Hour), EndAt: now.Add(2 * time.Hour)},
+	})
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/api/v1/ad?limit=1&infer=true", ""},
+		{"GET", "/api/v1/ad?offset=10", ""},
+		{"POST", "/api/v1/ad/search", `{"limit":1,"country":["TW"]}`},
+		{"POST", "/api/v1/ad/search", `{"placements":[{"id":"top","limit":1},{"id":"side","sort":"newest"}]}`},
+		{"GET", "/api/v1/country", ""},
+		{"GET", "/openapi.json", ""},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.Header.Set("User-Agent", "Mozilla/5.0 (Linux; Android 14)")
+		router.ServeHTTP(recorder, r)
+		route := strings.SplitN(c.path, "?", 2)[0]
+		response, ok := paths[route].(map[string]interface{})[strings.ToLower(c.method)].(map[string]interface{})["responses"].(map[string]interface{})[fmt.Sprint(recorder.Code)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s %s: status %d is not documented: %s", c.method, c.path, recorder.Code, recorder.Body.String())
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &value); err != nil {
+			t.Errorf("%s %s: unexpected error: %v", c.method, c.path, err)
+			continue
+		}
+		schema := response["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+		if err := checkSchema(doc, schema, value, "$"); err != nil {
+			t.Errorf("%s %s: %v", c.method, c.path, err)
+		}
+	}
+
+	//Checker must reject what the document does not allow
+	searchResponse := map[string]interface{}{"$ref": "#/components/schemas/SearchResponse"}
+	for _, body := range []string{`{"items":[],"total":0,"offset":0,"limit":5}`, `{"items":[],"total":0,"offset":0,"limit":5,"hasMore":false,"extra":1}`, `{"items":[{"title":1}],"total":0,"offset":0,"limit":5,"hasMore":false}`} {
+		var value interface{}
+		json.Unmarshal([]byte(body), &value)
+		if checkSchema(doc, searchResponse, value, "$") == nil {
+			t.Errorf("expected %s to be rejected", body)
+		}
+	}
+}
+
+/*
+v1 is deprecated but lenient, v2 shares handlers with lowercase keys and rejects unknown fields and params
+*/
+func TestAPIVersions(t *testing.T) {
+	defer func(index *adIndex) { servingIndex = index }(servingIndex)
+	now := getNowTime()
+	servingIndex = newAdIndex()
+	servingIndex.build([]Ad{{UUID: "1", Title: "first", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour)}})
+
+	router := newRouter()
+	cases := []struct {
+		method     string
+		path       string
+		body       string
+		status     int
+		deprecated bool
+	}{
+		{"GET", "/api/v1/ad?unknown=1", "", http.StatusOK, true},
+		{"GET", "/api/v2/ad?language=en&country=TW", "", http.StatusOK, false},
+		{"GET", "/api/v2/ad?unknown=1", "", http.StatusBadRequest, false},
+		{"POST", "/api/v1/ad/search", `{"limit":1,"unknown":1}`, http.StatusOK, true},
+		{"POST", "/api/v2/ad/search", `{"limit":1,"unknown":1}`, http.StatusBadRequest, false},
+		{"POST", "/api/v2/ad/search", `{"placements":[{"id":"top","limit":1,"unknown":1}]}`, http.StatusBadRequest, false},
+		{"POST", "/api/v2/ad", `{"title":"AD","conditions":{"Country:":["TW"]}}`, http.StatusBadRequest, false},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(recorder, r)
+		if recorder.Code != c.status {
+			t.Errorf("%s %s: unexpected status %d: %s", c.method, c.path, recorder.Code, recorder.Body.String())
+		}
+		if deprecated := recorder.Header().Get("Deprecation") != ""; deprecated != c.deprecated {
+			t.Errorf("%s %s: unexpected Deprecation header %q", c.method, c.path, recorder.Header().Get("Deprecation"))
+		}
+		if c.deprecated && (recorder.Header().Get("Sunset") == "" || !strings.Contains(recorder.Header().Get("Link"), "/api/v2/")) {
+			t.Errorf("%s %s: expected Sunset and successor Link headers", c.method, c.path)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/api/v2/ad", strings.NewReader(`{"title":"AD","conditions":{"gender":["F"],"country":["TW"],"platform":["ios"],"excludeCountry":["JP"]}}`))
+	r.Header.Set("Content-Type", "application/json")
+	ad, err := decodeAd(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, 2)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(ad.Conditions.Gender, ad.Conditions.Countries, ad.Conditions.Platforms, ad.Conditions.ExcludeCountries) != "[F] [TW] [ios] [JP]" {
+		t.Errorf("unexpected conditions: %+v", ad.Conditions)
+	}
+}
+
+/*
+v2 types mirror Ad field by field, a field added to Ad only would be dropped by v2 requests
+*/
+func TestAdV2Fields(t *testing.T) {
+	fieldsOf := func(t reflect.Type, skip string) []string {
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Name != skip {
+				fields = append(fields, t.Field(i).Name+" "+t.Field(i).Type.String())
+			}
+		}
+		return fields
+	}
+	ad := fieldsOf(reflect.TypeOf(Ad{}), "UUID")
+	v2 := fieldsOf(reflect.TypeOf(AdV2{}), "")
+	if fmt.Sprint(ad) != strings.Replace(fmt.Sprint(v2), "api.AdConditionV2", "api.AdCondition", 1) {
+		t.Errorf("Ad and AdV2 fields differ:\n%v\n%v", ad, v2)
+	}
+	if !reflect.TypeOf(AdConditionV2{}).ConvertibleTo(reflect.TypeOf(AdCondition{})) {
+		t.Errorf("AdConditionV2 does not convert to AdCondition")
+	}
+
+	//Every field survives toAd
+	now := time.Now().UTC()
+	min := 20
+	ad2 := AdV2{Title: "t", StartAt: now, EndAt: now.Add(time.Hour), Priority: 1, FrequencyCap: FrequencyCap{Max: 1, Period: "day"},
+		Budget: AdBudget{Total: 1}, Schedule: AdSchedule{Timezone: "UTC"}, Conditions: AdConditionV2{AgeRanges: []AgeRange{{Min: &min}}, Countries: []string{"TW"}}}
+	value := reflect.ValueOf(ad2.toAd())
+	for i := 0; i < value.NumField(); i++ {
+		if name := value.Type().Field(i).Name; name != "UUID" && value.Field(i).IsZero() {
+			t.Errorf("toAd drops %s", name)
+		}
+	}
+
+	for _, name := range []string{"offset", "limit", "userId", "deviceId", "sort", "cursor", "infer", "age", "gender", "country", "platform"} {
+		if !searchParams[name] {
+			t.Errorf("missing search param %s", name)
+		}
+	}
+	if searchParams["targeting"] {
+		t.Errorf("targeting is not a query param")
+	}
+}
+
+/*
+Admin body must be one JSON value of known fields within size limit with JSON content type, only v2 keys are case-sensitive
+*/
+func TestDecodeAdStrict(t *testing.T) {
+	cases := []struct {
+		body        string
+		contentType string
+		v2          bool
+		status      int
+		message     string
+	}{
+		{`{"title":"AD","conditions":{"Country":["TW"]}}`, "application/json; charset=utf-8", false, 0, ""},
+		{`{"title":"AD","conditions":{"country":["TW"]}}`, "application/json", false, 0, ""},
+		{`{"title":"AD","conditions":{"Country:":["TW"]}}`, "application/json", false, http.StatusBadRequest, "conditions.Country:"},
+		{`{"title":"AD","Schedule":{"hours":[{"start":"09:00","stop":"10:00"}]}}`, "application/json", false, http.StatusBadRequest, "Schedule.hours[0].stop"},
+		{`{"title":"AD"}`, "", false, http.StatusUnsupportedMediaType, "Content-Type"},
+		{`{"title":"AD"}`, "text/plain", false, http.StatusUnsupportedMediaType, "Content-Type"},
+		{`{"title":"AD","conditions":{"Country":["TW"]}}`, "application/json", true, http.StatusBadRequest, "conditions.Country"},
+		{`{"title":"AD","schedule":{"hours":[{"start":"09:00","stop":"10:00"}]}}`, "application/json", true, http.StatusBadRequest, "schedule.hours[0].stop"},
+		{`{"title":"AD","conditions":{"country":["TW"]}}`, "application/json", true, 0, ""},
+		{`{"title":"AD"}`, "", true, http.StatusUnsupportedMediaType, "Content-Type"},
+		{`{"title":"AD"}`, "text/plain", true, http.StatusUnsupportedMediaType, "Content-Type"},
+		{`{"title":"AD"} {"title":"AD2"}`, "application/json", false, http.StatusBadRequest, "single JSON value"},
+		{`{"title":"AD"}}`, "application/json", false, http.StatusBadRequest, "single JSON value"},
+		{`{"title":"` + strings.Repeat("A", int(maxAdBodyBytes)) + `"}`, "application/json", false, http.StatusRequestEntityTooLarge, "larger"},
+	}
+	for i, c := range cases {
+		r := httptest.NewRequest("POST", "/api/v1/ad", strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		if c.v2 {
+			r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, 2))
+		}
+		_, err := decodeAd(httptest.NewRecorder(), r)
+		if c.message == "" {
+			if err != nil {
+				t.Errorf("case %d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("case %d: expected error with %q: %v", i, c.message, err)
+			continue
+		}
+		status := http.StatusBadRequest
+		var bodyErr *requestBodyError
+		if errors.As(err, &bodyErr) {
+			status = bodyErr.status
+		}
+		if status != c.status {
+			t.Errorf("case %d: unexpected status %d want %d", i, status, c.status)
+		}
+	}
+
+	//Country groups are admin bodies too, rejected before reaching the database
+	for body, status := range map[string]int{
+		`{"name":"asia","country":["TW"]}`:                            http.StatusBadRequest,
+		`{"name":"` + strings.Repeat("A", int(maxAdBodyBytes)) + `"}`: http.StatusRequestEntityTooLarge,
+	} {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/country-group", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		countryGroupAPI(recorder, r)
+		if recorder.Code != status {
+			t.Errorf("unexpected country group status %d want %d: %s", recorder.Code, status, recorder.Body.String())
+		}
+	}
+	recorder := httptest.NewRecorder()
+	countryGroupAPI(recorder, httptest.NewRequest("POST", "/api/v1/country-group", strings.NewReader(`{"name":"asia"}`)))
+	if recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unexpected country group status without Content-Type: %d", recorder.Code)
+	}
+
+	now := time.Now()
+	for title, valid := range map[string]bool{
+		"Summer sale 夏季特賣 🎉":            true,
+		"   ":                           false,
+		strings.Repeat("廣", 100):        true,
+		strings.Repeat("廣", 101):        false,
+		"line\nbreak":                   false,
+		"right-to-left \u202e override": false,
+		"zero\u200bwidth":               false,
+		"family \U0001f468\u200d\U0001f469\u200d\U0001f467":                           true,
+		"flag \U0001f3f4\U000e0067\U000e0062\U000e0065\U000e006e\U000e0067\U000e007f": true,
+		"heart \u2764\ufe0f": true,
+	} {
+		err := validateAd(Ad{Title: title, StartAt: now, EndAt: now.Add(time.Hour)})
+		if (err == nil) != valid {
+			t.Errorf("unexpected validation of %q: %v", title, err)
+		}
+	}
+}
+
+/*
+Public responses carry ETag and Cache-Control, and If-None-Match with the same ETag gets 304
+*/
+func TestSearchHTTPCaching(t *testing.T) {
+	defer func(index *adIndex) { servingIndex = index }(servingIndex)
+	now := getNowTime()
+	servingIndex = newAdIndex()
+	servingIndex.build([]Ad{
+		{UUID: "1", Title: "first", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour)},
+		{UUID: "2", Title: "second", StartAt: now.Add(-time.Hour), EndAt: now.Add(2 * time.Hour)},
+	})
+	router := newRouter()
+	get := func(path string, ifNoneMatch string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		router.ServeHTTP(recorder, r)
+		return recorder
+	}
+
+	first := get("/api/v2/ad?limit=1", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("unexpected response: %d %q", first.Code, etag)
+	}
+	var maxAge int
+	if _, err := fmt.Sscanf(first.Header().Get("Cache-Control"), "private, max-age=%d", &maxAge); err != nil || maxAge < 3590 || maxAge > 3600 {
+		t.Errorf("unexpected Cache-Control: %q", first.Header().Get("Cache-Control"))
+	}
+	again := get("/api/v2/ad?limit=1", "")
+	if again.Header().Get("ETag") != etag {
+		t.Errorf("expected same ETag for same page")
+	}
+	if serve := again.Header().Get(serveTokenHeader); serve == "" || serve == first.Header().Get(serveTokenHeader) {
+		t.Errorf("expected a new serve token per response, got %q", serve)
+	}
+	notModified := get("/api/v2/ad?limit=1", `"other", W/`+etag)
+	if notModified.Code != http.StatusNotModified || notModified.Body.Len() != 0 || notModified.Header().Get("ETag") != etag {
+		t.Errorf("unexpected conditional response: %d %q", notModified.Code, notModified.Body.String())
+	}
+	if other := get("/api/v2/ad?limit=1&offset=1", etag); other.Code != http.StatusOK || other.Header().Get("ETag") == etag {
+		t.Errorf("expected other page to have another ETag")
+	}
+	if weighted := get("/api/v2/ad?sort=weighted", ""); weighted.Header().Get("Cache-Control") != "no-store" || weighted.Header().Get("ETag") != "" {
+		t.Errorf("expected random ranking not to be cached: %q", weighted.Header().Get("Cache-Control"))
+	}
+
+	page := encodedPage{expireAt: now.Add(90 * time.Second)}
+	cases := []struct {
+		condition SearchCondition
+		volatile  bool
+		expected  string
+	}{
+		{SearchCondition{Sort: "endAt"}, false, "private, max-age=90"},
+		{SearchCondition{Sort: "endAt", UserID: "u1"}, false, "private, max-age=90"},
+		{SearchCondition{Sort: "endAt", Infer: true}, false, "private, max-age=90"},
+		{SearchCondition{Sort: "endAt"}, true, "private, no-cache"},
+	}
+	for _, c := range cases {
+		page.volatile = c.volatile
+		if got := searchCacheControl(c.condition, page, now); got != c.expected {
+			t.Errorf("unexpected Cache-Control for %+v: got %q want %q", c.condition, got, c.expected)
+		}
+	}
+}
+
+// Ten results with tracking tokens, the default page of a busy placement
+func benchmarkSearchResponse() SearchResponse {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	response := SearchResponse{Items: []SearchResult{}, Total: 120, Limit: 10, HasMore: true, generation: 7, expireAt: now.Add(time.Hour)}
+	for i := 0; i < 10; i++ {
+		ad := Ad{UUID: fmt.Sprintf("00000000-0000-0000-0000-%012d", i), Title: fmt.Sprintf("Ad number %d with a realistic title", i), EndAt: now.Add(time.Duration(i) * time.Hour)}
+		response.Items = append(response.Items, SearchResult{Title: ad.Title, EndAt: ad.EndAt, Token: newTrackingToken(ad, "")})
+	}
+	return response
+}
+
+/*
+Pages are served gzip encoded when accepted, each encoding with its own ETag
+*/
+func TestWriteEncodedPage(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                          false,
+		"gzip":                      true,
+		"br, GZIP;q=0.5":            true,
+		"gzip;q=0":                  false,
+		"*":                         true,
+		"*;q=0.1, gzip;q=0":         false,
+		"identity, deflate":         false,
+		"deflate, *;q=0, identity":  false,
+		"deflate , gzip ; q=1.0, x": true,
+	} {
+		if got := acceptsGzip(header); got != expected {
+			t.Errorf("unexpected gzip acceptance of %q: %v", header, got)
+		}
+	}
+
+	condition := SearchCondition{Sort: defaultRanking}
+	page := encodePage(benchmarkSearchResponse())
+	write := func(acceptEncoding string, ifNoneMatch string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v2/ad", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		writeEncodedPage(recorder, r, condition, &page)
+		return recorder
+	}
+
+	plain := write("", "")
+	compressed := write("gzip", "")
+	if plain.Header().Get("Content-Encoding") != "" || compressed.Header().Get("Content-Encoding") != "gzip" || compressed.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("unexpected encodings: %v %v", plain.Header(), compressed.Header())
+	}
+	if compressed.Body.Len() >= plain.Body.Len() || plain.Header().Get("ETag") == compressed.Header().Get("ETag") {
+		t.Errorf("expected smaller gzip body with its own ETag")
+	}
+	reader, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decompressed, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(decompressed, plain.Body.Bytes()) {
+		t.Errorf("gzip body differs from plain body")
+	}
+	if notModified := write("gzip", compressed.Header().Get("ETag")); notModified.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for gzip ETag, got %d", notModified.Code)
+	}
+	if modified := write("", compressed.Header().Get("ETag")); modified.Code != http.StatusOK {
+		t.Errorf("expected gzip ETag not to match plain body, got %d", modified.Code)
+	}
+
+	small := encodePage(SearchResponse{Items: []SearchResult{}})
+	recorder := httptest.NewRecorder()
+	writeEncodedPage(recorder, httptest.NewRequest("GET", "/api/v2/ad", nil), condition, &small)
+	if recorder.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected small page not to be compressed")
+	}
+
+	if isPageCacheable(SearchCondition{Sort: defaultRanking, UserID: "u1"}) || isPageCacheable(SearchCondition{Sort: "weighted"}) {
+		t.Errorf("expected per user and random pages not to be cacheable")
+	}
+}
+
+/*
+Page cache: hash fields and expiry in Redis, generation read with the page and reused on miss
+*/
+func TestPageCacheRoundTrip(t *testing.T) {
+	server := useTestRedis(t)
+	condition := SearchCondition{Sort: defaultRanking, Limit: 5, Country: []string{"TW"}}
+	inferred := map[string]string{"country": "TW"}
+
+	if _, generation, ok := getCachedPage(condition, inferred); ok || generation != 0 {
+		t.Fatalf("unexpected hit on empty cache: generation %v", generation)
+	}
+
+	page := encodePage(benchmarkSearchResponse())
+	page.expireAt = time.UnixMilli(getNowTime().Add(time.Minute).UnixMilli())
+	saveCachedPage(condition, inferred, 0, &page)
+	volatile := encodePage(SearchResponse{Items: []SearchResult{}, expireAt: getNowTime().Add(time.Minute), volatile: true})
+	saveCachedPage(SearchCondition{Sort: defaultRanking, Limit: 1}, nil, 0, &volatile)
+
+	key, _ := pageCacheKey(condition, inferred, 0)
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != key || !strings.HasPrefix(key, cachePagePrefix+"0:") {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if server.HGet(key, "body") != string(page.body) || server.HGet(key, "gzip") != string(page.gzipBody) || len(page.gzipBody) == 0 {
+		t.Errorf("unexpected bodies stored")
+	}
+	if server.HGet(key, "etag") != page.etag || server.HGet(key, "expireAt") != strconv.FormatInt(page.expireAt.UnixMilli(), 10) {
+		t.Errorf("unexpected etag or expireAt: %v %v", server.HGet(key, "etag"), server.HGet(key, "expireAt"))
+	}
+	if ttl := server.TTL(key); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("unexpected ttl: %v", ttl)
+	}
+
+	cached, generation, ok := getCachedPage(condition, inferred)
+	if !ok || generation != 0 {
+		t.Fatalf("expected hit in generation 0, got %v %v", ok, generation)
+	}
+	if !bytes.Equal(cached.body, page.body) || !bytes.Equal(cached.gzipBody, page.gzipBody) || cached.etag != page.etag || !cached.expireAt.Equal(page.expireAt) {
+		t.Errorf("unexpected cached page: %+v", cached)
+	}
+
+	//Clearing the cache bumps generation, old pages are no longer read
+	server.Incr(cacheGenerationKey, 1)
+	if _, generation, ok := getCachedPage(condition, inferred); ok || generation != 1 {
+		t.Errorf("expected miss in generation 1, got %v %v", ok, generation)
+	}
+
+	//Candidates are looked up in the generation passed, without reading it again
+	conditionJson, _ := json.Marshal(condition)
+	server.Set(fmt.Sprintf("%s%d:%s", cacheEntryPrefix, 1, conditionJson), string(encodeCachedAds([]Ad{{UUID: "1", Title: "first"}})))
+	server.Set(cacheGenerationKey, "5")
+	ads, generation, _, hit, err := getCachedAdsByCondition(condition, 1)
+	if err != nil || !hit || generation != 1 || len(ads) != 1 || ads[0].Title != "first" {
+		t.Errorf("unexpected cached ads: %v %v %v %v", ads, generation, hit, err)
+	}
+
+	server.Close()
+	if _, generation, ok := getCachedPage(condition, inferred); ok || generation != unknownGeneration {
+		t.Errorf("expected unknown generation when Redis is down, got %v %v", ok, generation)
+	}
+}
+
+/*
+Encoding the response per request, as handlers did before pages were cached
+*/
+func BenchmarkEncodeSearchResponse(b *testing.B) {
+	response := benchmarkSearchResponse()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+/*
+Writing a pre-serialized page with caching headers
+*/
+func BenchmarkWriteEncodedPage(b *testing.B) {
+	page := encodePage(benchmarkSearchResponse())
+	condition := SearchCondition{Sort: defaultRanking}
+	r := httptest.NewRequest("GET", "/api/v2/ad", nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeEncodedPage(httptest.NewRecorder(), r, condition, &page)
+	}
+}
+
+/*
+Writing a pre-compressed page to a client accepting gzip
+*/
+func BenchmarkWriteEncodedPageGzip(b *testing.B) {
+	page := encodePage(benchmarkSearchResponse())
+	page.compress()
+	condition := SearchCondition{Sort: defaultRanking}
+	r := httptest.NewRequest("GET", "/api/v2/ad", nil)
+	r.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		writeEncodedPage(httptest.NewRecorder(), r, condition, &page)
+	}
+}
+
+/*
+Compressing per request, what uncached pages cost gzip clients
+*/
+func BenchmarkCompressPage(b *testing.B) {
+	page := encodePage(benchmarkSearchResponse())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fresh := page
+		fresh.gzipBody = nil
+		fresh.compress()
+	}
+}
+
+// Matched ads with every field set, as they come from the database
+func benchmarkCachedAds() []Ad {
+	taipei := time.FixedZone("Asia/Taipei", 8*60*60)
+	start := time.Date(2024, 3, 1, 8, 0, 0, 123456789, taipei)
+	minAge, maxAge := 20, 30
+	var ads []Ad
+	for i := 0; i < 50; i++ {
+		ads = append(ads, Ad{
+			UUID:         fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			Title:        fmt.Sprintf("Ad number %d with a realistic title", i),
+			StartAt:      start,
+			EndAt:        start.AddDate(0, 0, i+1),
+			Priority:     i % 5,
+			FrequencyCap: FrequencyCap{Max: 3, Period: "day"},
+			Budget:       AdBudget{Total: 10000, Daily: 500, Pacing: "even"},
+			Schedule:     AdSchedule{Timezone: "Asia/Taipei", Days: []string{"mon", "tue"}, Hours: []ScheduleHours{{Start: "18:00", End: "23:00"}}},
+			Conditions:   AdCondition{AgeRanges: []AgeRange{{Min: &minAge, Max: &maxAge}}, Gender: []string{"F"}, Countries: []string{"TW", "JP"}, Platforms: []string{"ios", "web"}},
+		})
+	}
+	return ads
+}
+
+/*
+Cached ads keep what searches need in a versioned binary format, other versions and corrupt data are rejected
+*/
+func TestCachedAdsFormat(t *testing.T) {
+	ads := benchmarkCachedAds()
+	var projected []Ad
+	for _, ad := range ads {
+		projected = append(projected, cacheProjection(ad))
+	}
+	data := encodeCachedAds(projected)
+	decoded, err := decodeCachedAds(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, projected) {
+		t.Fatalf("decoded ads differ from projection:\n%+v\n%+v", decoded[0], projected[0])
+	}
+	first := decoded[0]
+	if first.UUID != ads[0].UUID || first.Title != ads[0].Title || !first.EndAt.Equal(ads[0].EndAt.Truncate(time.Microsecond)) ||
+		first.FrequencyCap != ads[0].FrequencyCap || first.Budget != ads[0].Budget || first.Conditions.Countries != nil {
+		t.Errorf("unexpected projection: %+v", first)
+	}
+	if first.EndAt.Location() != time.UTC {
+		t.Errorf("expected times in UTC, got %v", first.EndAt.Location())
+	}
+
+	type entry struct {
+		Ad
+		UUID string `json:"uuid"`
+	}
+	var entries []entry
+	for _, ad := range ads {
+		entries = append(entries, entry{ad, ad.UUID})
+	}
+	jsonData, _ := json.Marshal(entries)
+	if len(data)*3 > len(jsonData) {
+		t.Errorf("expected binary entry to be at most a third of JSON, got %d and %d bytes", len(data), len(jsonData))
+	}
+
+	if empty, err := decodeCachedAds(encodeCachedAds(nil)); err != nil || len(empty) != 0 {
+		t.Errorf("unexpected empty list: %v %v", empty, err)
+	}
+	for name, corrupt := range map[string][]byte{
+		"json":      jsonData,
+		"empty":     {},
+		"version":   append([]byte{cacheFormatVersion + 1}, data[1:]...),
+		"truncated": data[:len(data)-1],
+		"trailing":  append(append([]byte{}, data...), 0),
+		"count":     {cacheFormatVersion, 0xff, 0xff, 0xff, 0xff, 0x0f},
+	} {
+		if _, err := decodeCachedAds(corrupt); err != errCacheFormat {
+			t.Errorf("expected %s data to be rejected, got %v", name, err)
+		}
+	}
+}
+
+/*
+Reading a cache entry of 50 ads as it was stored before, full ads as JSON
+*/
+func BenchmarkDecodeCachedAdsJSON(b *testing.B) {
+	type entry struct {
+		Ad
+		UUID string `json:"uuid"`
+	}
+	var entries []entry
+	for _, ad := range benchmarkCachedAds() {
+		entries = append(entries, entry{ad, ad.UUID})
+	}
+	data, _ := json.Marshal(entries)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var decoded []entry
+		json.Unmarshal(data, &decoded)
+	}
+}
+
+/*
+Reading the same entry in the compact format
+*/
+func BenchmarkDecodeCachedAds(b *testing.B) {
+	var projected []Ad
+	for _, ad := range benchmarkCachedAds() {
+		projected = append(projected, cacheProjection(ad))
+	}
+	data := encodeCachedAds(projected)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		decodeCachedAds(data)
+	}
+}
+
+/*
+Load test queries and ads are valid, skewed toward popular values and repeat with the same seed
+*/
+func TestLoadTestQueryMix(t *testing.T) {
+	config := loadTestConfig{tailShare: 0.05, userShare: 0.1}
+	mix := newQueryMix(config)
+	rng := rand.New(rand.NewSource(1))
+	countries := map[string]int{}
+	users := 0
+	for i := 0; i < 5000; i++ {
+		query := mix.next(rng)
+		r := httptest.NewRequest("GET", "/api/v2/ad?"+query.Encode(), nil)
+		if _, err := validateSearchParamAndAssignDefaultVal(r); err != nil {
+			t.Fatalf("invalid query %s: %v", query.Encode(), err)
+		}
+		countries[query.Get("country")]++
+		if query.Get("userId") != "" {
+			users++
+		}
+	}
+	if countries["TW"] < 1500 || countries["TW"] < 2*countries["JP"] || len(countries) < 40 {
+		t.Errorf("expected skewed countries with a long tail, got %d TW, %d JP, %d distinct", countries["TW"], countries["JP"], len(countries))
+	}
+	if users < 350 || users > 650 {
+		t.Errorf("expected about 10%% of queries with userId, got %d", users)
+	}
+	if a, b := mix.next(rand.New(rand.NewSource(7))).Encode(), mix.next(rand.New(rand.NewSource(7))).Encode(); a != b {
+		t.Errorf("expected same query for same seed, got %s and %s", a, b)
+	}
+
+	now := getNowTime()
+	for i := 0; i < 200; i++ {
+		ad := syntheticAd(rng, mix, "0123abcd", i, now)
+		if err := validateAd(ad); err != nil {
+			t.Fatalf("invalid synthetic ad %+v: %v", ad, err)
+		}
+		if !strings.HasPrefix(ad.Title, "[loadtest 0123abcd] ") {
+			t.Fatalf("expected synthetic ad to be tagged with its run: %s", ad.Title)
+		}
+		if !ad.StartAt.Before(now) || !ad.EndAt.After(now) {
+			t.Fatalf("expected synthetic ad to be active: %+v", ad)
+		}
+	}
+}
+
+/*
+Load test sends requests at the target rate and reports errors, cache hits and latencies
+*/
+func TestRunLoadTest(t *testing.T) {
+	var requests int
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if r.URL.Path != "/api/v2/ad" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if n%10 == 0 {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if n%2 == 0 {
+			w.Header().Set("X-Cache", "HIT")
+		} else {
+			w.Header().Set("X-Cache", "MISS")
+		}
+		w.Write([]byte(`{"items":[]}`))
+	}))
+	defer server.Close()
+
+	config := loadTestConfig{target: server.URL, rps: 1000, duration: 300 * time.Millisecond, concurrency: 20, tailShare: 0.05, seed: 1}
+	result := runLoadTest(config, newQueryMix(config))
+	if result.sent+result.dropped != 300 || result.sent != requests {
+		t.Fatalf("expected 300 scheduled requests, got %d sent, %d dropped, %d received", result.sent, result.dropped, requests)
+	}
+	if result.failed != result.statuses["500"] || result.failed != requests/10 {
+		t.Errorf("unexpected failures: %d %v", result.failed, result.statuses)
+	}
+	if result.cacheReported != result.statuses["200"] || result.cacheHits != requests*4/10 || len(result.latencies) != result.sent {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if percentile(result.latencies, 50) > percentile(result.latencies, 99) || percentile(result.latencies, 100) != result.latencies[len(result.latencies)-1] {
+		t.Errorf("unexpected percentiles")
+	}
+
+	var report bytes.Buffer
+	result.report(&report)
+	for _, expected := range []string{fmt.Sprintf("%d sent", result.sent), fmt.Sprintf("Errors:     %d (", result.failed), fmt.Sprintf("500: %d", result.failed), "p99", "Cache hits: "} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("expected %q in report:\n%s", expected, report.String())
+		}
+	}
+}
+
+/*
+Load test latency includes the time a request waited for a free worker after its scheduled send time
+*/
+func TestRunLoadTestQueueing(t *testing.T) {
+	const serviceTime = 30 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(serviceTime)
+	}))
+	defer server.Close()
+
+	//One worker and requests every 10ms, the second request waits for the first one
+	config := loadTestConfig{target: server.URL, rps: 100, duration: 100 * time.Millisecond, concurrency: 1, seed: 1}
+	result := runLoadTest(config, newQueryMix(config))
+	if result.sent < 2 {
+		t.Fatalf("expected queued requests, got %d sent", result.sent)
+	}
+	if slowest := percentile(result.latencies, 100); slowest < 2*serviceTime-15*time.Millisecond {
+		t.Errorf("expected queueing delay in latency, slowest was %v", slowest)
+	}
+}
+
+/*
+Load test cleanup deletes only the ads of its run and publishes their deletion
+*/
+func TestDeleteLoadTestRun(t *testing.T) {
+	mock := useTestDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT pg_advisory_xact_lock($1)").WithArgs(adQuotaLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("DELETE FROM ad WHERE starts_with(title, $1) RETURNING uuid").WithArgs("[loadtest 0123abcd] ").
+		WillReturnRows(sqlmock.NewRows([]string{"uuid"}).AddRow("a"))
+	mock.ExpectExec("INSERT INTO ad_change (ad_uuid, op, created_at) VALUES ($1, $2, $3)").WithArgs("a", adDeleted, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("SELECT pg_notify($1, '')").WithArgs(adChangeChannel).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	deleted, err := deleteAdsByTitlePrefix(loadTestTitlePrefix("0123abcd"))
+	if err != nil || deleted != 1 {
+		t.Errorf("unexpected cleanup result: %v %v", deleted, err)
+	}
+
+	for run, valid := range map[string]bool{"0123abcd": true, "": false, "a] b": false, "%": false} {
+		if isValidLoadTestRun(run) != valid {
+			t.Errorf("unexpected validity of run %q", run)
+		}
+	}
+}
+
+/*
+Placements of one batch are resolved first and served together, an ad matching several placements fills one and is charged once.
+Later placements skip ads of earlier ones before paginating, so they are still filled up to limit
+*/
+func TestBatchSearchChargesOnce(t *testing.T) {
+	server := useTestRedis(t)
+	defer func(index *adIndex) { servingIndex = index }(servingIndex)
+	now := getNowTime()
+	budgeted := Ad{UUID: "1", Title: "budgeted", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour),
+		Budget: AdBudget{Total: 5}, FrequencyCap: FrequencyCap{Max: 3, Period: "day"}, Conditions: AdCondition{Countries: []string{"TW"}}}
+	servingIndex = newAdIndex()
+	servingIndex.build([]Ad{
+		budgeted,
+		{UUID: "2", Title: "other", StartAt: now.Add(-time.Hour), EndAt: now.Add(2 * time.Hour), Conditions: AdCondition{Countries: []string{"TW"}}},
+		{UUID: "3", Title: "third", StartAt: now.Add(-time.Hour), EndAt: now.Add(3 * time.Hour)},
+	})
+
+	body := `{"placements":[{"id":"top","limit":1,"country":["TW"],"userId":"u1"},{"id":"side","limit":2,"country":["TW"],"userId":"u1"}]}`
+	r := httptest.NewRequest("POST", "/api/v2/ad/search", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	newRouter().ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
+	}
+	var batch BatchSearchResponse
+	json.Unmarshal(recorder.Body.Bytes(), &batch)
+	if len(batch.Placements) != 2 || len(batch.Placements[0].Items) != 1 || batch.Placements[0].Items[0].Title != "budgeted" ||
+		len(batch.Placements[1].Items) != 2 || batch.Placements[1].Items[0].Title != "other" || batch.Placements[1].Items[1].Title != "third" {
+		t.Fatalf("unexpected placements: %s", recorder.Body.String())
+	}
+	if side := batch.Placements[1]; side.Total != 2 || side.HasMore || side.NextCursor != "" {
+		t.Errorf("expected side total and paging without served ads, got %+v", side)
+	}
+
+	totalKey, _, _, _ := budgetKeys(budgeted, now)
+	if charged, _ := server.Get(totalKey); charged != "1" {
+		t.Errorf("expected budget charged once, got %q", charged)
+	}
+	frequencyCounter, _ := frequencyKey("u1", budgeted, now)
+	if impressions, _ := server.Get(frequencyCounter); impressions != "1" {
+		t.Errorf("expected one impression recorded, got %q", impressions)
+	}
+}
+
+/*
+Change feed: changes reach subscribers in order, a failed change stops the poll and is retried from the saved checkpoint
+*/
+func TestChangeFeedPoll(t *testing.T) {
+	mock := useTestDB(t)
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	os.WriteFile(checkpoint, []byte("5\n"), 0644)
+	feed, err := newChangeFeed(checkpoint)
+	if err != nil || feed.seq != 5 {
+		t.Fatalf("expected feed to resume from checkpoint: %v %v", feed, err)
+	}
+
+	var applied []string
+	failing := true
+	feed.subscribe(func(change adChange) error {
+		applied = append(applied, "index:"+change.UUID)
+		return nil
+	}, nil)
+	feed.subscribe(func(change adChange) error {
+		if change.Seq == 7 && failing {
+			return errors.New("cache down")
+		}
+		applied = append(applied, "cache:"+change.UUID)
+		return nil
+	}, nil)
+
+	query := "SELECT seq, ad_uuid, op FROM ad_change WHERE seq > $1 ORDER BY seq LIMIT $2"
+	columns := []string{"seq", "ad_uuid", "op"}
+	mock.ExpectQuery(query).WithArgs(5, feedBatchSize).WillReturnRows(sqlmock.NewRows(columns).AddRow(6, "a", adCreated).AddRow(7, "b", adDeleted))
+	if err := feed.poll(); err == nil {
+		t.Errorf("expected failed change to fail poll")
+	}
+	if saved, _ := os.ReadFile(checkpoint); feed.seq != 6 || string(saved) != "6" {
+		t.Errorf("expected position after last applied change, got %v and checkpoint %q", feed.seq, saved)
+	}
+
+	failing = false
+	mock.ExpectQuery(query).WithArgs(6, feedBatchSize).WillReturnRows(sqlmock.NewRows(columns).AddRow(7, "b", adDeleted))
+	if err := feed.poll(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Join(applied, ","); got != "index:a,cache:a,index:b,index:b,cache:b" {
+		t.Errorf("unexpected order of changes: %v", got)
+	}
+	if saved, _ := os.ReadFile(checkpoint); string(saved) != "7" {
+		t.Errorf("unexpected checkpoint: %q", saved)
+	}
+}
+
+/*
+Change feed: a subscriber that has not polled for half of retention may have missed pruned changes, it resyncs from latest change
+*/
+func TestChangeFeedResync(t *testing.T) {
+	mock := useTestDB(t)
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	feed := &changeFeed{seq: 3, polledAt: getNowTime().Add(-feedRetention), checkpointPath: checkpoint}
+	resynced := 0
+	feed.subscribe(func(adChange) error {
+		t.Errorf("unexpected change")
+		return nil
+	}, func() error {
+		resynced++
+		return nil
+	})
+
+	query := "SELECT seq, ad_uuid, op FROM ad_change WHERE seq > $1 ORDER BY seq LIMIT $2"
+	columns := []string{"seq", "ad_uuid", "op"}
+	mock.ExpectQuery("SELECT COALESCE(MAX(seq), 0) FROM ad_change").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(20))
+	mock.ExpectQuery(query).WithArgs(20, feedBatchSize).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(query).WithArgs(20, feedBatchSize).WillReturnRows(sqlmock.NewRows(columns))
+	for i := 0; i < 2; i++ {
+		if err := feed.poll(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if saved, _ := os.ReadFile(checkpoint); resynced != 1 || feed.seq != 20 || string(saved) != "20" {
+		t.Errorf("expected one resync to latest change, got %v resyncs at %v and checkpoint %q", resynced, feed.seq, saved)
+	}
+}
+
+/*
+Change feed: outbox rows older than retention are deleted
+*/
+func TestPruneAdChanges(t *testing.T) {
+	mock := useTestDB(t)
+	before := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("DELETE FROM ad_change WHERE created_at < $1").WithArgs(before).WillReturnResult(sqlmock.NewResult(0, 3))
+	deleted, err := pruneAdChanges(before)
+	if err != nil || deleted != 3 {
+		t.Errorf("unexpected prune result: %v %v", deleted, err)
+	}
+}
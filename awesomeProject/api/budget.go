@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Delivery modes of a budget, asap serves until exhausted, even spreads impressions over the schedule
+var pacingModes = map[string]bool{
+	"asap": true,
+	"even": true,
+}
+
+// Counters stay a while after the ad ends so late reports still see them
+const budgetCounterGrace = 24 * time.Hour
+
+// Charges one impression while both budgets have room, returns 1 when charged and 0 when a budget is used up
+var chargeBudgetScript = redis.NewScript(`
+local totalBudget = tonumber(ARGV[1])
+local dailyBudget = tonumber(ARGV[2])
+local total = tonumber(redis.call('GET', KEYS[1]) or '0')
+local daily = tonumber(redis.call('GET', KEYS[2]) or '0')
+if (totalBudget > 0 and total >= totalBudget) or (dailyBudget > 0 and daily >= dailyBudget) then
+	return 0
+end
+redis.call('INCR', KEYS[1])
+redis.call('EXPIREAT', KEYS[1], ARGV[3])
+redis.call('INCR', KEYS[2])
+redis.call('EXPIREAT', KEYS[2], ARGV[4])
+return 1
+`)
+
+func hasBudget(ad Ad) bool {
+	return ad.Budget.Total > 0 || ad.Budget.Daily > 0
+}
+
+// Redis keys of total and today's impressions, and when each expires
+func budgetKeys(ad Ad, now time.Time) (string, string, time.Time, time.Time) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	totalKey := fmt.Sprintf("ad:budget:%s:total", ad.UUID)
+	dailyKey := fmt.Sprintf("ad:budget:%s:%s", ad.UUID, today.Format("20060102"))
+	return totalKey, dailyKey, ad.EndAt.Add(budgetCounterGrace), today.AddDate(0, 0, 1).Add(budgetCounterGrace)
+}
+
+// Impressions allowed so far when budget is spread evenly over [from, to], one impression of slack
+func pacedAllowance(budget int64, from time.Time, to time.Time, now time.Time) int64 {
+	if !now.After(from) {
+		return 1
+	}
+	if !now.Before(to) {
+		return budget
+	}
+	elapsed := float64(now.Sub(from)) / float64(to.Sub(from))
+	return int64(float64(budget)*elapsed) + 1
+}
+
+// Whether ad can be served with total and today's impressions already served
+func withinBudget(ad Ad, total int64, daily int64, now time.Time) bool {
+	if ad.Budget.Total > 0 && total >= ad.Budget.Total {
+		return false
+	}
+	if ad.Budget.Daily > 0 && daily >= ad.Budget.Daily {
+		return false
+	}
+	if ad.Budget.Pacing != "even" {
+		return true
+	}
+	if ad.Budget.Total > 0 && total >= pacedAllowance(ad.Budget.Total, ad.StartAt, ad.EndAt, now) {
+		return false
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if ad.Budget.Daily > 0 && daily >= pacedAllowance(ad.Budget.Daily, today, today.AddDate(0, 0, 1), now) {
+		return false
+	}
+	return true
+}
+
+// Drop ads whose budget is used up or which are ahead of their pace.
+// Counters are read on every request, so exhausted ads leave cached results right away.
+func filterBudgetExhausted(ads []Ad, now time.Time) []Ad {
+	var keys []string
+	for _, ad := range ads {
+		if hasBudget(ad) {
+			totalKey, dailyKey, _, _ := budgetKeys(ad, now)
+			keys = append(keys, totalKey, dailyKey)
+		}
+	}
+	if len(keys) == 0 {
+		return ads
+	}
+
+	//Without counters ads keep being served rather than all budgeted ads disappearing
+	values, err := redisClient.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		println("Cannot read budget counters: ", err.Error())
+		return ads
+	}
+	counts := make([]int64, len(values))
+	for i, value := range values {
+		if value != nil {
+			fmt.Sscan(value.(string), &counts[i])
+		}
+	}
+
+	var result = []Ad{}
+	i := 0
+	for _, ad := range ads {
+		if hasBudget(ad) {
+			total, daily := counts[i], counts[i+1]
+			i += 2
+			if !withinBudget(ad, total, daily, now) {
+				continue
+			}
+		}
+		result = append(result, ad)
+	}
+	return result
+}
+
+// Charge one impression to each budgeted ad, returns ads that could be charged
+func chargeBudgets(ads []Ad, now time.Time) []Ad {
+	ctx := context.Background()
+	var charged = []Ad{}
+	for _, ad := range ads {
+		if !hasBudget(ad) {
+			charged = append(charged, ad)
+			continue
+		}
+		totalKey, dailyKey, totalExpireAt, dailyExpireAt := budgetKeys(ad, now)
+		result, err := chargeBudgetScript.Run(ctx, redisClient, []string{totalKey, dailyKey}, ad.Budget.Total, ad.Budget.Daily, totalExpireAt.Unix(), dailyExpireAt.Unix()).Int()
+		if err != nil {
+			println("Cannot charge budget: ", err.Error())
+			charged = append(charged, ad)
+			continue
+		}
+		if result == 1 {
+			charged = append(charged, ad)
+		}
+	}
+	return charged
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Version of cached candidate lists, entries of any other version are read as misses and rebuilt.
+// Bump it whenever the layout below changes.
+const cacheFormatVersion byte = 1
+
+var errCacheFormat = errors.New("cached ads are not in the current format")
+
+// Fields of an ad searches use once it was matched: title and endAt for the response,
+// the rest for ranking, cursors, frequency caps, budgets and tracking tokens.
+// Schedules are applied before caching and the entry expires at the next boundary, so they are left out like conditions.
+// Times are kept in UTC with microseconds, as stored by Postgres.
+func cacheProjection(ad Ad) Ad {
+	return Ad{
+		UUID:         ad.UUID,
+		Title:        ad.Title,
+		StartAt:      time.UnixMicro(ad.StartAt.UnixMicro()).UTC(),
+		EndAt:        time.UnixMicro(ad.EndAt.UnixMicro()).UTC(),
+		Priority:     ad.Priority,
+		FrequencyCap: ad.FrequencyCap,
+		Budget:       ad.Budget,
+	}
+}
+
+// Version byte, ad count, then per ad:
+// uuid, title, startAt, endAt (unix microseconds), priority, frequency cap max and period, budget total, daily and pacing.
+// Strings are length prefixed, numbers are varints.
+func encodeCachedAds(ads []Ad) []byte {
+	data := []byte{cacheFormatVersion}
+	data = binary.AppendUvarint(data, uint64(len(ads)))
+	for _, ad := range ads {
+		data = appendCacheString(data, ad.UUID)
+		data = appendCacheString(data, ad.Title)
+		data = binary.AppendVarint(data, ad.StartAt.UnixMicro())
+		data = binary.AppendVarint(data, ad.EndAt.UnixMicro())
+		data = binary.AppendVarint(data, int64(ad.Priority))
+		data = binary.AppendVarint(data, int64(ad.FrequencyCap.Max))
+		data = appendCacheString(data, ad.FrequencyCap.Period)
+		data = binary.AppendVarint(data, ad.Budget.Total)
+		data = binary.AppendVarint(data, ad.Budget.Daily)
+		data = appendCacheString(data, ad.Budget.Pacing)
+	}
+	return data
+}
+
+func appendCacheString(data []byte, value string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+// Ads of encodeCachedAds, errCacheFormat for other versions or malformed data
+func decodeCachedAds(data []byte) ([]Ad, error) {
+	if len(data) == 0 || data[0] != cacheFormatVersion {
+		return nil, errCacheFormat
+	}
+	reader := cacheReader{data: data[1:]}
+	count := reader.uvarint()
+	//Each ad takes at least 10 bytes, a corrupt count must not allocate
+	if count > uint64(len(reader.data))/10 {
+		return nil, errCacheFormat
+	}
+	ads := make([]Ad, 0, count)
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		var ad Ad
+		ad.UUID = reader.string()
+		ad.Title = reader.string()
+		ad.StartAt = time.UnixMicro(reader.varint()).UTC()
+		ad.EndAt = time.UnixMicro(reader.varint()).UTC()
+		ad.Priority = int(reader.varint())
+		ad.FrequencyCap.Max = int(reader.varint())
+		ad.FrequencyCap.Period = reader.string()
+		ad.Budget.Total = reader.varint()
+		ad.Budget.Daily = reader.varint()
+		ad.Budget.Pacing = reader.string()
+		ads = append(ads, ad)
+	}
+	if reader.err != nil || len(reader.data) > 0 {
+		return nil, errCacheFormat
+	}
+	return ads, nil
+}
+
+// Reads values in order, the first failure is kept and later reads return zero values
+type cacheReader struct {
+	data []byte
+	err  error
+}
+
+func (r *cacheReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errCacheFormat
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *cacheReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errCacheFormat
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *cacheReader) string() string {
+	length := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if length > uint64(len(r.data)) {
+		r.err = errCacheFormat
+		return ""
+	}
+	value := string(r.data[:length])
+	r.data = r.data[length:]
+	return value
+}
@@ -0,0 +1,497 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ISO 3166-1 country
+type countryInfo struct {
+	Alpha2 string `json:"alpha2"`
+	Alpha3 string `json:"alpha3"`
+	Name   string `json:"name"`
+}
+
+var iso3166Countries = []countryInfo{
+	{"AD", "AND", "Andorra"},
+	{"AE", "ARE", "United Arab Emirates"},
+	{"AF", "AFG", "Afghanistan"},
+	{"AG", "ATG", "Antigua and Barbuda"},
+	{"AI", "AIA", "Anguilla"},
+	{"AL", "ALB", "Albania"},
+	{"AM", "ARM", "Armenia"},
+	{"AO", "AGO", "Angola"},
+	{"AQ", "ATA", "Antarctica"},
+	{"AR", "ARG", "Argentina"},
+	{"AS", "ASM", "American Samoa"},
+	{"AT", "AUT", "Austria"},
+	{"AU", "AUS", "Australia"},
+	{"AW", "ABW", "Aruba"},
+	{"AX", "ALA", "Åland Islands"},
+	{"AZ", "AZE", "Azerbaijan"},
+	{"BA", "BIH", "Bosnia and Herzegovina"},
+	{"BB", "BRB", "Barbados"},
+	{"BD", "BGD", "Bangladesh"},
+	{"BE", "BEL", "Belgium"},
+	{"BF", "BFA", "Burkina Faso"},
+	{"BG", "BGR", "Bulgaria"},
+	{"BH", "BHR", "Bahrain"},
+	{"BI", "BDI", "Burundi"},
+	{"BJ", "BEN", "Benin"},
+	{"BL", "BLM", "Saint Barthélemy"},
+	{"BM", "BMU", "Bermuda"},
+	{"BN", "BRN", "Brunei Darussalam"},
+	{"BO", "BOL", "Bolivia"},
+	{"BQ", "BES", "Bonaire, Sint Eustatius and Saba"},
+	{"BR", "BRA", "Brazil"},
+	{"BS", "BHS", "Bahamas"},
+	{"BT", "BTN", "Bhutan"},
+	{"BV", "BVT", "Bouvet Island"},
+	{"BW", "BWA", "Botswana"},
+	{"BY", "BLR", "Belarus"},
+	{"BZ", "BLZ", "Belize"},
+	{"CA", "CAN", "Canada"},
+	{"CC", "CCK", "Cocos (Keeling) Islands"},
+	{"CD", "COD", "Congo, The Democratic Republic of the"},
+	{"CF", "CAF", "Central African Republic"},
+	{"CG", "COG", "Congo"},
+	{"CH", "CHE", "Switzerland"},
+	{"CI", "CIV", "Côte d'Ivoire"},
+	{"CK", "COK", "Cook Islands"},
+	{"CL", "CHL", "Chile"},
+	{"CM", "CMR", "Cameroon"},
+	{"CN", "CHN", "China"},
+	{"CO", "COL", "Colombia"},
+	{"CR", "CRI", "Costa Rica"},
+	{"CU", "CUB", "Cuba"},
+	{"CV", "CPV", "Cabo Verde"},
+	{"CW", "CUW", "Curaçao"},
+	{"CX", "CXR", "Christmas Island"},
+	{"CY", "CYP", "Cyprus"},
+	{"CZ", "CZE", "Czechia"},
+	{"DE", "DEU", "Germany"},
+	{"DJ", "DJI", "Djibouti"},
+	{"DK", "DNK", "Denmark"},
+	{"DM", "DMA", "Dominica"},
+	{"DO", "DOM", "Dominican Republic"},
+	{"DZ", "DZA", "Algeria"},
+	{"EC", "ECU", "Ecuador"},
+	{"EE", "EST", "Estonia"},
+	{"EG", "EGY", "Egypt"},
+	{"EH", "ESH", "Western Sahara"},
+	{"ER", "ERI", "Eritrea"},
+	{"ES", "ESP", "Spain"},
+	{"ET", "ETH", "Ethiopia"},
+	{"FI", "FIN", "Finland"},
+	{"FJ", "FJI", "Fiji"},
+	{"FK", "FLK", "Falkland Islands (Malvinas)"},
+	{"FM", "FSM", "Micronesia, Federated States of"},
+	{"FO", "FRO", "Faroe Islands"},
+	{"FR", "FRA", "France"},
+	{"GA", "GAB", "Gabon"},
+	{"GB", "GBR", "United Kingdom"},
+	{"GD", "GRD", "Grenada"},
+	{"GE", "GEO", "Georgia"},
+	{"GF", "GUF", "French Guiana"},
+	{"GG", "GGY", "Guernsey"},
+	{"GH", "GHA", "Ghana"},
+	{"GI", "GIB", "Gibraltar"},
+	{"GL", "GRL", "Greenland"},
+	{"GM", "GMB", "Gambia"},
+	{"GN", "GIN", "Guinea"},
+	{"GP", "GLP", "Guadeloupe"},
+	{"GQ", "GNQ", "Equatorial Guinea"},
+	{"GR", "GRC", "Greece"},
+	{"GS", "SGS", "South Georgia and the South Sandwich Islands"},
+	{"GT", "GTM", "Guatemala"},
+	{"GU", "GUM", "Guam"},
+	{"GW", "GNB", "Guinea-Bissau"},
+	{"GY", "GUY", "Guyana"},
+	{"HK", "HKG", "Hong Kong"},
+	{"HM", "HMD", "Heard Island and McDonald Islands"},
+	{"HN", "HND", "Honduras"},
+	{"HR", "HRV", "Croatia"},
+	{"HT", "HTI", "Haiti"},
+	{"HU", "HUN", "Hungary"},
+	{"ID", "IDN", "Indonesia"},
+	{"IE", "IRL", "Ireland"},
+	{"IL", "ISR", "Israel"},
+	{"IM", "IMN", "Isle of Man"},
+	{"IN", "IND", "India"},
+	{"IO", "IOT", "British Indian Ocean Territory"},
+	{"IQ", "IRQ", "Iraq"},
+	{"IR", "IRN", "Iran"},
+	{"IS", "ISL", "Iceland"},
+	{"IT", "ITA", "Italy"},
+	{"JE", "JEY", "Jersey"},
+	{"JM", "JAM", "Jamaica"},
+	{"JO", "JOR", "Jordan"},
+	{"JP", "JPN", "Japan"},
+	{"KE", "KEN", "Kenya"},
+	{"KG", "KGZ", "Kyrgyzstan"},
+	{"KH", "KHM", "Cambodia"},
+	{"KI", "KIR", "Kiribati"},
+	{"KM", "COM", "Comoros"},
+	{"KN", "KNA", "Saint Kitts and Nevis"},
+	{"KP", "PRK", "North Korea"},
+	{"KR", "KOR", "South Korea"},
+	{"KW", "KWT", "Kuwait"},
+	{"KY", "CYM", "Cayman Islands"},
+	{"KZ", "KAZ", "Kazakhstan"},
+	{"LA", "LAO", "Laos"},
+	{"LB", "LBN", "Lebanon"},
+	{"LC", "LCA", "Saint Lucia"},
+	{"LI", "LIE", "Liechtenstein"},
+	{"LK", "LKA", "Sri Lanka"},
+	{"LR", "LBR", "Liberia"},
+	{"LS", "LSO", "Lesotho"},
+	{"LT", "LTU", "Lithuania"},
+	{"LU", "LUX", "Luxembourg"},
+	{"LV", "LVA", "Latvia"},
+	{"LY", "LBY", "Libya"},
+	{"MA", "MAR", "Morocco"},
+	{"MC", "MCO", "Monaco"},
+	{"MD", "MDA", "Moldova"},
+	{"ME", "MNE", "Montenegro"},
+	{"MF", "MAF", "Saint Martin (French part)"},
+	{"MG", "MDG", "Madagascar"},
+	{"MH", "MHL", "Marshall Islands"},
+	{"MK", "MKD", "North Macedonia"},
+	{"ML", "MLI", "Mali"},
+	{"MM", "MMR", "Myanmar"},
+	{"MN", "MNG", "Mongolia"},
+	{"MO", "MAC", "Macao"},
+	{"MP", "MNP", "Northern Mariana Islands"},
+	{"MQ", "MTQ", "Martinique"},
+	{"MR", "MRT", "Mauritania"},
+	{"MS", "MSR", "Montserrat"},
+	{"MT", "MLT", "Malta"},
+	{"MU", "MUS", "Mauritius"},
+	{"MV", "MDV", "Maldives"},
+	{"MW", "MWI", "Malawi"},
+	{"MX", "MEX", "Mexico"},
+	{"MY", "MYS", "Malaysia"},
+	{"MZ", "MOZ", "Mozambique"},
+	{"NA", "NAM", "Namibia"},
+	{"NC", "NCL", "New Caledonia"},
+	{"NE", "NER", "Niger"},
+	{"NF", "NFK", "Norfolk Island"},
+	{"NG", "NGA", "Nigeria"},
+	{"NI", "NIC", "Nicaragua"},
+	{"NL", "NLD", "Netherlands"},
+	{"NO", "NOR", "Norway"},
+	{"NP", "NPL", "Nepal"},
+	{"NR", "NRU", "Nauru"},
+	{"NU", "NIU", "Niue"},
+	{"NZ", "NZL", "New Zealand"},
+	{"OM", "OMN", "Oman"},
+	{"PA", "PAN", "Panama"},
+	{"PE", "PER", "Peru"},
+	{"PF", "PYF", "French Polynesia"},
+	{"PG", "PNG", "Papua New Guinea"},
+	{"PH", "PHL", "Philippines"},
+	{"PK", "PAK", "Pakistan"},
+	{"PL", "POL", "Poland"},
+	{"PM", "SPM", "Saint Pierre and Miquelon"},
+	{"PN", "PCN", "Pitcairn"},
+	{"PR", "PRI", "Puerto Rico"},
+	{"PS", "PSE", "Palestine, State of"},
+	{"PT", "PRT", "Portugal"},
+	{"PW", "PLW", "Palau"},
+	{"PY", "PRY", "Paraguay"},
+	{"QA", "QAT", "Qatar"},
+	{"RE", "REU", "Réunion"},
+	{"RO", "ROU", "Romania"},
+	{"RS", "SRB", "Serbia"},
+	{"RU", "RUS", "Russian Federation"},
+	{"RW", "RWA", "Rwanda"},
+	{"SA", "SAU", "Saudi Arabia"},
+	{"SB", "SLB", "Solomon Islands"},
+	{"SC", "SYC", "Seychelles"},
+	{"SD", "SDN", "Sudan"},
+	{"SE", "SWE", "Sweden"},
+	{"SG", "SGP", "Singapore"},
+	{"SH", "SHN", "Saint Helena, Ascension and Tristan da Cunha"},
+	{"SI", "SVN", "Slovenia"},
+	{"SJ", "SJM", "Svalbard and Jan Mayen"},
+	{"SK", "SVK", "Slovakia"},
+	{"SL", "SLE", "Sierra Leone"},
+	{"SM", "SMR", "San Marino"},
+	{"SN", "SEN", "Senegal"},
+	{"SO", "SOM", "Somalia"},
+	{"SR", "SUR", "Suriname"},
+	{"SS", "SSD", "South Sudan"},
+	{"ST", "STP", "Sao Tome and Principe"},
+	{"SV", "SLV", "El Salvador"},
+	{"SX", "SXM", "Sint Maarten (Dutch part)"},
+	{"SY", "SYR", "Syria"},
+	{"SZ", "SWZ", "Eswatini"},
+	{"TC", "TCA", "Turks and Caicos Islands"},
+	{"TD", "TCD", "Chad"},
+	{"TF", "ATF", "French Southern Territories"},
+	{"TG", "TGO", "Togo"},
+	{"TH", "THA", "Thailand"},
+	{"TJ", "TJK", "Tajikistan"},
+	{"TK", "TKL", "Tokelau"},
+	{"TL", "TLS", "Timor-Leste"},
+	{"TM", "TKM", "Turkmenistan"},
+	{"TN", "TUN", "Tunisia"},
+	{"TO", "TON", "Tonga"},
+	{"TR", "TUR", "Türkiye"},
+	{"TT", "TTO", "Trinidad and Tobago"},
+	{"TV", "TUV", "Tuvalu"},
+	{"TW", "TWN", "Taiwan"},
+	{"TZ", "TZA", "Tanzania"},
+	{"UA", "UKR", "Ukraine"},
+	{"UG", "UGA", "Uganda"},
+	{"UM", "UMI", "United States Minor Outlying Islands"},
+	{"US", "USA", "United States"},
+	{"UY", "URY", "Uruguay"},
+	{"UZ", "UZB", "Uzbekistan"},
+	{"VA", "VAT", "Holy See (Vatican City State)"},
+	{"VC", "VCT", "Saint Vincent and the Grenadines"},
+	{"VE", "VEN", "Venezuela"},
+	{"VG", "VGB", "Virgin Islands, British"},
+	{"VI", "VIR", "Virgin Islands, U.S."},
+	{"VN", "VNM", "Vietnam"},
+	{"VU", "VUT", "Vanuatu"},
+	{"WF", "WLF", "Wallis and Futuna"},
+	{"WS", "WSM", "Samoa"},
+	{"YE", "YEM", "Yemen"},
+	{"YT", "MYT", "Mayotte"},
+	{"ZA", "ZAF", "South Africa"},
+	{"ZM", "ZMB", "Zambia"},
+	{"ZW", "ZWE", "Zimbabwe"},
+}
+
+// Alpha-2 code by upper case alpha-2 or alpha-3 code
+var countryCodes = buildCountryCodes()
+
+func buildCountryCodes() map[string]string {
+	codes := map[string]string{}
+	for _, country := range iso3166Countries {
+		codes[country.Alpha2] = country.Alpha2
+		codes[country.Alpha3] = country.Alpha2
+	}
+	return codes
+}
+
+// Alpha-2 code of an alpha-2 or alpha-3 code in any case
+func normalizeCountry(value string) (string, bool) {
+	code, ok := countryCodes[strings.ToUpper(value)]
+	return code, ok
+}
+
+// Country groups every deployment has, custom ones are stored in country_group table
+var builtinCountryGroups = map[string][]string{
+	"EU":    strings.Fields("AT BE BG HR CY CZ DK EE FI FR DE GR HU IE IT LV LT LU MT NL PL PT RO SK SI ES SE"),
+	"APAC":  strings.Fields("AU BD BN BT CN FJ HK ID IN JP KH KI KR LA LK MM MN MO MV MY NP NZ PG PH PK SB SG TH TL TO TV TW VN VU WS"),
+	"LATAM": strings.Fields("AR BO BR CL CO CR CU DO EC GT HN MX NI PA PE PR PY SV UY VE"),
+}
+
+var countryGroupName = regexp.MustCompile(`^[A-Z][A-Z0-9_]{1,31}$`)
+
+// Members of a built-in or custom group, found is false when there is no such group
+func getCountryGroup(name string) ([]string, bool, error) {
+	name = strings.ToUpper(name)
+	if countries, ok := builtinCountryGroups[name]; ok {
+		return countries, true, nil
+	}
+	var countriesJson string
+	err := dbClient.QueryRow("SELECT countries FROM country_group WHERE name = $1", name).Scan(&countriesJson)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var countries []string
+	err = json.Unmarshal([]byte(countriesJson), &countries)
+	return countries, true, err
+}
+
+// Country codes and group names to alpha-2 codes, in order and without duplicates
+func expandCountries(values []string) ([]string, error) {
+	var result []string
+	seen := map[string]bool{}
+	add := func(code string) {
+		if !seen[code] {
+			seen[code] = true
+			result = append(result, code)
+		}
+	}
+	for _, value := range values {
+		if code, ok := normalizeCountry(value); ok {
+			add(code)
+			continue
+		}
+		countries, found, err := getCountryGroup(value)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errors.New("Country not in ISO3166 and not a country group: " + value)
+		}
+		for _, code := range countries {
+			add(code)
+		}
+	}
+	return result, nil
+}
+
+// Replace groups and alpha-3 codes in ad's country lists by alpha-2 codes.
+// Excluded countries are taken out of included groups, so "EU" except "DE" works, but the same value on both sides is rejected.
+func expandAdCountries(condition *AdCondition) error {
+	for _, included := range condition.Countries {
+		for _, excluded := range condition.ExcludeCountries {
+			if strings.EqualFold(included, excluded) {
+				return errors.New("Country " + included + " is both included and excluded")
+			}
+		}
+	}
+
+	included, err := expandCountries(condition.Countries)
+	if err != nil {
+		return err
+	}
+	excluded, err := expandCountries(condition.ExcludeCountries)
+	if err != nil {
+		return err
+	}
+	var remaining []string
+	for _, code := range included {
+		if !contains(excluded, code) {
+			remaining = append(remaining, code)
+		}
+	}
+	if len(included) > 0 && len(remaining) == 0 {
+		return errors.New("Excluded countries leave no included country")
+	}
+	condition.Countries = remaining
+	condition.ExcludeCountries = excluded
+	return nil
+}
+
+// Admin api request and response of country groups
+type CountryGroup struct {
+	Name      string   `json:"name"`
+	Countries []string `json:"countries"`
+	Builtin   bool     `json:"builtin,omitempty"`
+}
+
+func saveCountryGroup(group CountryGroup) error {
+	countriesJson, err := json.Marshal(group.Countries)
+	if err != nil {
+		return err
+	}
+	_, err = dbClient.Exec("INSERT INTO country_group (name, countries) VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET countries = EXCLUDED.countries", group.Name, string(countriesJson))
+	return err
+}
+
+func getCountryGroups() ([]CountryGroup, error) {
+	var groups = []CountryGroup{}
+	for name, countries := range builtinCountryGroups {
+		groups = append(groups, CountryGroup{Name: name, Countries: countries, Builtin: true})
+	}
+	rows, err := dbClient.Query("SELECT name, countries FROM country_group")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var group CountryGroup
+		var countriesJson string
+		err := rows.Scan(&group.Name, &countriesJson)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(countriesJson), &group.Countries)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, rows.Err()
+}
+
+func validateCountryGroup(group *CountryGroup) error {
+	group.Name = strings.ToUpper(group.Name)
+	if !countryGroupName.MatchString(group.Name) {
+		return errors.New("group name can only be letters, digits and _, 2 to 32 characters")
+	}
+	if _, ok := normalizeCountry(group.Name); ok {
+		return errors.New("group name cannot be a country code")
+	}
+	if _, ok := builtinCountryGroups[group.Name]; ok {
+		return errors.New("built-in group cannot be changed")
+	}
+	if len(group.Countries) == 0 {
+		return errors.New("group needs at least one country")
+	}
+	var countries []string
+	for _, value := range group.Countries {
+		code, ok := normalizeCountry(value)
+		if !ok {
+			return errors.New("Country not in ISO3166: " + value)
+		}
+		if !contains(countries, code) {
+			countries = append(countries, code)
+		}
+	}
+	group.Countries = countries
+	return nil
+}
+
+// Handles POST /api/v1/country-group, creates or replaces a custom group.
+// Ads expand groups when saved, changing a group does not change existing ads.
+func countryGroupAPI(w http.ResponseWriter, r *http.Request) {
+	var group CountryGroup
+	err := decodeStrictJSON(w, r, &group, isV2(r))
+	var bodyErr *requestBodyError
+	if errors.As(err, &bodyErr) {
+		http.Error(w, err.Error(), bodyErr.status)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to decode JSON request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = validateCountryGroup(&group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = saveCountryGroup(group)
+	if err != nil {
+		http.Error(w, "Database error "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// Handles GET /api/v1/country-group
+func listCountryGroupsAPI(w http.ResponseWriter, r *http.Request) {
+	groups, err := getCountryGroups()
+	if err != nil {
+		http.Error(w, "Database error "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": groups})
+}
+
+// Handles GET /api/v1/country
+func listCountriesAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": iso3166Countries})
+}
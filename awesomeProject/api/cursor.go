@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Key signing opaque values handed to clients.
+// Replicas must share AD_SIGNING_KEY, otherwise a cursor only works on the replica that issued it.
+var signingKey = loadSigningKey()
+
+func loadSigningKey() []byte {
+	if key := os.Getenv("AD_SIGNING_KEY"); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Position after the last ad of a page.
+// Seeking by the last ad's sort key keeps pages free of duplicates and gaps when active ads change between requests,
+// when generation is still the same the position is used directly.
+type searchCursor struct {
+	Generation int64     `json:"g"`
+	Position   int       `json:"p"`
+	Sort       string    `json:"s"`
+	EndAt      time.Time `json:"e"`
+	StartAt    time.Time `json:"st"`
+	Priority   int       `json:"pr"`
+	UUID       string    `json:"u"`
+}
+
+func newSearchCursor(generation int64, position int, sort string, last Ad) searchCursor {
+	return searchCursor{
+		Generation: generation,
+		Position:   position,
+		Sort:       sort,
+		EndAt:      last.EndAt,
+		StartAt:    last.StartAt,
+		Priority:   last.Priority,
+		UUID:       last.UUID,
+	}
+}
+
+// Signs payload and encodes it as "<payload>.<signature>", both base64url
+func signToken(payload []byte) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func verifyToken(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)[:16]) {
+		return nil, errors.New("invalid token signature")
+	}
+	return payload, nil
+}
+
+func encodeCursor(cursor searchCursor) string {
+	payload, _ := json.Marshal(cursor)
+	return signToken(payload)
+}
+
+func decodeCursor(value string) (searchCursor, error) {
+	var cursor searchCursor
+	payload, err := verifyToken(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(payload, &cursor)
+	return cursor, err
+}
+
+// Ads are sorted by endAt then uuid
+func adBefore(endAt time.Time, id string, ad Ad) bool {
+	if endAt.Equal(ad.EndAt) {
+		return id < ad.UUID
+	}
+	return endAt.Before(ad.EndAt)
+}
+
+// Index of first ad after cursor, ads are ranked by cursor's strategy
+func seekCursor(ads []Ad, cursor searchCursor, generation int64, seed string) int {
+	if cursor.Generation == generation && cursor.Position > 0 && cursor.Position <= len(ads) && ads[cursor.Position-1].UUID == cursor.UUID {
+		return cursor.Position
+	}
+	last := Ad{UUID: cursor.UUID, StartAt: cursor.StartAt, EndAt: cursor.EndAt, Priority: cursor.Priority}
+	less := rankingStrategies[cursor.Sort]
+	return sort.Search(len(ads), func(i int) bool {
+		return less(last, ads[i], seed)
+	})
+}
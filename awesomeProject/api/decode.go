@@ -0,0 +1,140 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Admin request bodies of ads and country groups larger than this are rejected
+var maxAdBodyBytes = int64(getEnvInt("AD_MAX_BODY_BYTES", 64*1024))
+
+// Request rejected before its JSON is decoded, with the status it is reported as
+type requestBodyError struct {
+	status  int
+	message string
+}
+
+func (e *requestBodyError) Error() string {
+	return e.message
+}
+
+// Read a body of one JSON value within maxAdBodyBytes into v, with a JSON Content-Type and no fields v does not have.
+// Unknown fields are reported with their path. v2 keys must match exactly,
+// v1 keys match case-insensitively like encoding/json always did, so "country" still fills Country.
+func decodeStrictJSON(w http.ResponseWriter, r *http.Request, v interface{}, caseSensitive bool) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return &requestBodyError{http.StatusUnsupportedMediaType, "Content-Type must be application/json"}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAdBodyBytes))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &requestBodyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", maxAdBodyBytes)}
+	}
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("request body must contain a single JSON value")
+	}
+	if err := checkUnknownFields(raw, reflect.TypeOf(v).Elem(), "", caseSensitive); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// Error naming the first field of data t has no field for, e.g. conditions.Country:
+func checkUnknownFields(data json.RawMessage, t reflect.Type, path string, caseSensitive bool) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		var items []json.RawMessage
+		if json.Unmarshal(data, &items) != nil {
+			return nil
+		}
+		for i, item := range items {
+			if err := checkUnknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), caseSensitive); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		var values map[string]json.RawMessage
+		if json.Unmarshal(data, &values) != nil {
+			return nil
+		}
+		for key, value := range values {
+			if err := checkUnknownFields(value, t.Elem(), joinFieldPath(path, key), caseSensitive); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		var values map[string]json.RawMessage
+		//Type errors are left to json.Unmarshal, time.Time is a string
+		if json.Unmarshal(data, &values) != nil {
+			return nil
+		}
+		fields := jsonFields(t)
+		for key, value := range values {
+			field, ok := fields[key]
+			for name, f := range fields {
+				if !ok && !caseSensitive && strings.EqualFold(name, key) {
+					field, ok = f, true
+				}
+			}
+			if !ok {
+				return errors.New("unknown field " + joinFieldPath(path, key))
+			}
+			if err := checkUnknownFields(value, field.Type, joinFieldPath(path, key), caseSensitive); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Fields of struct by JSON name, embedded structs without tag are flattened like encoding/json does
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if field.Anonymous && tag == "" {
+			for name, f := range jsonFields(field.Type) {
+				fields[name] = f
+			}
+			continue
+		}
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func joinFieldPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
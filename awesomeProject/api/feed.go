@@ -0,0 +1,270 @@
+package api
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Change operations carried by the feed
+const (
+	adCreated = "create"
+	adUpdated = "update"
+	adDeleted = "delete"
+)
+
+// Postgres channel notified after each committed change, so replicas do not wait for next poll
+const adChangeChannel = "ad_change"
+
+// Upper bound of the delay between a commit and a replica seeing it, when notifications are lost
+var feedPollInterval = time.Duration(getEnvInt("AD_FEED_POLL_MS", 1000)) * time.Millisecond
+
+// File keeping last applied sequence number, empty means start from latest change
+var feedCheckpointPath = os.Getenv("AD_FEED_CHECKPOINT")
+
+// How long outbox rows are kept, replicas that could not poll for half of it resync from the ad table
+var feedRetention = time.Duration(getEnvInt("AD_FEED_RETENTION_HOURS", 24)) * time.Hour
+
+const feedBatchSize = 500
+
+// One row of ad_change outbox
+type adChange struct {
+	Seq  int64
+	UUID string
+	Op   string
+}
+
+// Writes change into outbox inside the ad's transaction.
+// Writers hold the quota advisory lock, so sequence numbers are committed in order and readers never skip one.
+func publishAdChange(tx *sql.Tx, id string, op string, now time.Time) error {
+	_, err := tx.Exec("INSERT INTO ad_change (ad_uuid, op, created_at) VALUES ($1, $2, $3)", id, op, now)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("SELECT pg_notify($1, '')", adChangeChannel)
+	return err
+}
+
+func getAdChangesAfter(seq int64, limit int) ([]adChange, error) {
+	rows, err := dbClient.Query("SELECT seq, ad_uuid, op FROM ad_change WHERE seq > $1 ORDER BY seq LIMIT $2", seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []adChange
+	for rows.Next() {
+		var change adChange
+		err := rows.Scan(&change.Seq, &change.UUID, &change.Op)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func getLatestAdChangeSeq() (int64, error) {
+	var seq int64
+	err := dbClient.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM ad_change").Scan(&seq)
+	return seq, err
+}
+
+// Outbox rows older than retention, a subscriber behind them resyncs before reading on
+func pruneAdChanges(before time.Time) (int64, error) {
+	result, err := dbClient.Exec("DELETE FROM ad_change WHERE created_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Prune outbox until process exits, every instance may run it since deletes are idempotent
+func runChangePruner(interval time.Duration) {
+	for range time.Tick(interval) {
+		_, err := pruneAdChanges(getNowTime().Add(-feedRetention))
+		if err != nil {
+			log.Println("Cannot prune change feed: ", err)
+		}
+	}
+}
+
+// Subscriber of change feed, resync reloads its whole state when changes may have been pruned before it applied them
+type feedSubscriber struct {
+	apply  func(adChange) error
+	resync func() error
+}
+
+// Change feed of one replica, delivers every change after seq to subscribers in order
+type changeFeed struct {
+	mu             sync.Mutex
+	seq            int64
+	polledAt       time.Time
+	checkpointPath string
+	subscribers    []feedSubscriber
+}
+
+// Resume from checkpoint file if there is one, otherwise from latest change.
+// The search cache lives in Redis and outlives the process, it must see changes committed while the process was down.
+// The serving index is loaded after the feed position is taken, changes it gets again are applied twice which is harmless.
+func newChangeFeed(checkpointPath string) (*changeFeed, error) {
+	feed := &changeFeed{checkpointPath: checkpointPath}
+	if checkpointPath != "" {
+		content, err := os.ReadFile(checkpointPath)
+		if err == nil {
+			feed.seq, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			//Changes after it may have been pruned since, poll resyncs when it is too old
+			info, err := os.Stat(checkpointPath)
+			if err != nil {
+				return nil, err
+			}
+			feed.polledAt = info.ModTime()
+			return feed, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	seq, err := getLatestAdChangeSeq()
+	if err != nil {
+		return nil, err
+	}
+	feed.seq = seq
+	feed.polledAt = getNowTime()
+	return feed, nil
+}
+
+func (feed *changeFeed) subscribe(apply func(adChange) error, resync func() error) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	feed.subscribers = append(feed.subscribers, feedSubscriber{apply: apply, resync: resync})
+}
+
+// Apply all pending changes, a failed change is retried by next poll.
+// Position is saved after every batch, also when a change of it failed.
+func (feed *changeFeed) poll() error {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+
+	//Rows are pruned after retention, half of it leaves room for slow polls and clock skew
+	now := getNowTime()
+	if now.Sub(feed.polledAt) > feedRetention/2 {
+		err := feed.resync()
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		changes, err := getAdChangesAfter(feed.seq, feedBatchSize)
+		if err != nil {
+			return err
+		}
+		seq := feed.seq
+		err = feed.apply(changes)
+		if feed.seq != seq {
+			if saveErr := feed.saveCheckpoint(); saveErr != nil && err == nil {
+				err = saveErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if len(changes) < feedBatchSize {
+			feed.polledAt = now
+			return nil
+		}
+	}
+}
+
+// Deliver changes to every subscriber in order, seq moves past each change all subscribers applied
+func (feed *changeFeed) apply(changes []adChange) error {
+	for _, change := range changes {
+		for _, subscriber := range feed.subscribers {
+			err := subscriber.apply(change)
+			if err != nil {
+				return err
+			}
+		}
+		feed.seq = change.Seq
+	}
+	return nil
+}
+
+// Move to latest change and reload every subscriber, changes in between are applied again which is harmless
+func (feed *changeFeed) resync() error {
+	seq, err := getLatestAdChangeSeq()
+	if err != nil {
+		return err
+	}
+	for _, subscriber := range feed.subscribers {
+		err = subscriber.resync()
+		if err != nil {
+			return err
+		}
+	}
+	feed.seq = seq
+	return feed.saveCheckpoint()
+}
+
+func (feed *changeFeed) saveCheckpoint() error {
+	if feed.checkpointPath == "" {
+		return nil
+	}
+	//Write then rename, a crash never leaves half a checkpoint
+	tmpPath := feed.checkpointPath + ".tmp"
+	err := os.WriteFile(tmpPath, []byte(strconv.FormatInt(feed.seq, 10)), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, feed.checkpointPath)
+}
+
+// Keep search cache and, when enabled, serving index in sync with changes of every instance
+func startChangeFeed(withServingIndex bool) {
+	feed, err := newChangeFeed(feedCheckpointPath)
+	if err != nil {
+		log.Fatal("Cannot start change feed: ", err)
+	}
+	//Any change can add or remove matches of cached searches, every instance bumps the shared generation
+	feed.subscribe(func(adChange) error { return invalidateSearchCache() }, invalidateSearchCache)
+	if withServingIndex {
+		startServingIndex(feed)
+	}
+	go feed.run(feedPollInterval)
+}
+
+// Poll on every notification and at least once per interval
+func (feed *changeFeed) run(interval time.Duration) {
+	listener := pq.NewListener(databaseURL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Change feed listener: ", err)
+		}
+	})
+	err := listener.Listen(adChangeChannel)
+	if err != nil {
+		log.Println("Cannot listen to change feed, falling back to polling: ", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-listener.Notify:
+		case <-ticker.C:
+		}
+		err := feed.poll()
+		if err != nil {
+			log.Println("Cannot poll change feed: ", err)
+		}
+	}
+}
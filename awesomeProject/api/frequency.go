@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Periods a frequency cap can count impressions in, windows start at UTC boundaries
+var frequencyCapPeriods = map[string]bool{
+	"hour": true,
+	"day":  true,
+	"week": true,
+}
+
+const defaultFrequencyCapPeriod = "day"
+
+const maxFrequencyCap = 1000
+
+// Start and end of the period window containing now
+func frequencyWindow(period string, now time.Time) (time.Time, time.Time) {
+	switch period {
+	case "hour":
+		start := now.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	case "week":
+		//Weeks start on Monday
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	default:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// Impression counter of one user and ad in current window
+func frequencyKey(userID string, ad Ad, now time.Time) (string, time.Time) {
+	start, end := frequencyWindow(ad.FrequencyCap.Period, now)
+	return fmt.Sprintf("ad:fcap:%s:%s:%d", ad.UUID, userID, start.Unix()), end
+}
+
+// Counters used while Redis is unavailable, only seen by this replica
+type localCounters struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	expireAt map[string]time.Time
+}
+
+var fallbackCounters = &localCounters{counts: map[string]int{}, expireAt: map[string]time.Time{}}
+
+func (c *localCounters) get(key string, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expireAt[key].Before(now) {
+		return 0
+	}
+	return c.counts[key]
+}
+
+func (c *localCounters) incr(key string, expireAt time.Time, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, at := range c.expireAt {
+		if at.Before(now) {
+			delete(c.counts, k)
+			delete(c.expireAt, k)
+		}
+	}
+	c.counts[key]++
+	c.expireAt[key] = expireAt
+}
+
+// Drop ads whose cap is exhausted for user, ads without cap are always kept
+func filterFrequencyCapped(ads []Ad, userID string, now time.Time) []Ad {
+	var keys []string
+	for _, ad := range ads {
+		if ad.FrequencyCap.Max > 0 {
+			key, _ := frequencyKey(userID, ad, now)
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return ads
+	}
+
+	counts := make([]int, len(keys))
+	values, err := redisClient.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		println("Frequency cap falls back to local counters: ", err.Error())
+		for i, key := range keys {
+			counts[i] = fallbackCounters.get(key, now)
+		}
+	} else {
+		for i, value := range values {
+			if value != nil {
+				fmt.Sscan(value.(string), &counts[i])
+			}
+		}
+	}
+
+	var result = []Ad{}
+	i := 0
+	for _, ad := range ads {
+		if ad.FrequencyCap.Max > 0 {
+			count := counts[i]
+			i++
+			if count >= ad.FrequencyCap.Max {
+				continue
+			}
+		}
+		result = append(result, ad)
+	}
+	return result
+}
+
+// Count one impression of every capped ad served to user
+func recordImpressions(ads []Ad, userID string, now time.Time) {
+	ctx := context.Background()
+	pipe := redisClient.Pipeline()
+	type counter struct {
+		key      string
+		expireAt time.Time
+	}
+	var counters []counter
+	for _, ad := range ads {
+		if ad.FrequencyCap.Max > 0 {
+			key, expireAt := frequencyKey(userID, ad, now)
+			pipe.Incr(ctx, key)
+			pipe.ExpireAt(ctx, key, expireAt)
+			counters = append(counters, counter{key: key, expireAt: expireAt})
+		}
+	}
+	if len(counters) == 0 {
+		return
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		println("Frequency cap falls back to local counters: ", err.Error())
+		for _, c := range counters {
+			fallbackCounters.incr(c.key, c.expireAt, now)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Offline GeoIP database, CSV rows of "start_ip,end_ip,country" with inclusive IPv4 or IPv6 ranges
+var geoIPPath = os.Getenv("AD_GEOIP_DB")
+
+// Comma separated CIDRs of proxies whose X-Forwarded-For is trusted
+var trustedProxies = parseTrustedProxies(os.Getenv("AD_TRUSTED_PROXIES"))
+
+type geoIPRange struct {
+	start   netip.Addr
+	end     netip.Addr
+	country string
+}
+
+// Ranges sorted by start, nil until database is loaded
+var geoIPRanges []geoIPRange
+
+func parseTrustedProxies(value string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			println("Ignoring invalid trusted proxy: ", cidr)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+func loadGeoIPDatabase(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	ranges, err := readGeoIPRanges(file)
+	if err != nil {
+		return err
+	}
+	geoIPRanges = ranges
+	return nil
+}
+
+// Parse and sort ranges, header and comment lines starting with # are skipped
+func readGeoIPRanges(r io.Reader) ([]geoIPRange, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+	var ranges []geoIPRange
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, err := netip.ParseAddr(strings.TrimSpace(record[0]))
+		if err != nil {
+			//Header row
+			if len(ranges) == 0 {
+				continue
+			}
+			return nil, err
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, err
+		}
+		country, ok := normalizeCountry(strings.TrimSpace(record[2]))
+		if !ok || start.Is4() != end.Is4() || end.Less(start) {
+			return nil, errors.New("invalid GeoIP range " + strings.Join(record, ","))
+		}
+		ranges = append(ranges, geoIPRange{start: start.Unmap(), end: end.Unmap(), country: country})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start.Less(ranges[j].start)
+	})
+	return ranges, nil
+}
+
+// Country of ip, false when no range contains it
+func lookupCountry(ranges []geoIPRange, ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ip.Less(ranges[i].start)
+	})
+	if i == 0 {
+		return "", false
+	}
+	r := ranges[i-1]
+	if r.start.Is4() != ip.Is4() || r.end.Less(ip) {
+		return "", false
+	}
+	return r.country, true
+}
+
+func isTrustedProxy(ip netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client address of request. X-Forwarded-For is read right to left only while hops are trusted proxies,
+// so clients cannot pick their address by sending the header themselves. A malformed hop gives no address.
+func clientIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return ip, false
+	}
+	if !isTrustedProxy(ip) {
+		return ip.Unmap(), true
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		ip = hop.Unmap()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip, true
+}
+
+// Platform of User-Agent, empty when it is not a known client
+func platformFromUserAgent(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"), strings.Contains(userAgent, "iPod"):
+		return "ios"
+	case strings.Contains(userAgent, "Android"):
+		return "android"
+	case strings.HasPrefix(userAgent, "Mozilla/"):
+		return "web"
+	}
+	return ""
+}
+
+// Fill country and platform the request did not send, returns inferred values by param name
+func inferSearchCondition(r *http.Request, condition *SearchCondition) map[string]string {
+	var inferred = map[string]string{}
+	if len(condition.Country) == 0 && geoIPRanges != nil {
+		if ip, ok := clientIP(r); ok {
+			if country, ok := lookupCountry(geoIPRanges, ip); ok {
+				condition.Country = []string{country}
+				inferred["country"] = country
+			}
+		}
+	}
+	if len(condition.Platform) == 0 {
+		if platform := platformFromUserAgent(r.UserAgent()); platform != "" {
+			condition.Platform = []string{platform}
+			inferred["platform"] = platform
+		}
+	}
+	return inferred
+}
@@ -0,0 +1,270 @@
+package api
+
+//go:generate protoc -I adpb --go_out=adpb --go_opt=paths=source_relative --go-grpc_out=adpb --go-grpc_opt=paths=source_relative ad.proto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"awesomeProject/api/adpb"
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Port of grpc service, disabled unless set since it accepts writes like the admin api
+var grpcPort = getEnvInt("AD_GRPC_PORT", 0)
+
+const defaultListPageSize = 100
+const maxListPageSize = 1000
+
+// Ad service over grpc, uses the same validation and model code as the http api
+type adServer struct {
+	adpb.UnimplementedAdServiceServer
+}
+
+func newGRPCServer() *grpc.Server {
+	server := grpc.NewServer()
+	adpb.RegisterAdServiceServer(server, adServer{})
+	return server
+}
+
+// Serve grpc next to the http router until listener fails
+func serveGRPC(lis net.Listener) {
+	err := newGRPCServer().Serve(lis)
+	if err != nil {
+		println("grpc server stopped: ", err.Error())
+	}
+}
+
+// Status of errors from shared code, same classes as the http status codes of the http api
+func grpcError(err error) error {
+	var invalidErr *invalidAdError
+	if errors.As(err, &invalidErr) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	var quotaErr *quotaError
+	if errors.As(err, &quotaErr) {
+		return status.Error(codes.ResourceExhausted, "Quota exceeded: "+err.Error())
+	}
+	return status.Error(codes.Internal, "Database error "+err.Error())
+}
+
+func (adServer) SearchAds(ctx context.Context, req *adpb.SearchAdsRequest) (*adpb.SearchAdsResponse, error) {
+	request := searchRequest{
+		UserID:   req.UserId,
+		DeviceID: req.DeviceId,
+		Sort:     req.Sort,
+		Cursor:   req.Cursor,
+		Gender:   req.Gender,
+		Country:  req.Country,
+		Platform: req.Platform,
+	}
+	if req.Offset != nil {
+		offset := int(*req.Offset)
+		request.Offset = &offset
+	}
+	if req.Limit != nil {
+		limit := int(*req.Limit)
+		request.Limit = &limit
+	}
+	for _, age := range req.Age {
+		request.Age = append(request.Age, int(age))
+	}
+	request.Targeting = valuesFromProto(req.Targeting)
+
+	condition, err := validateSearchRequest(request)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid param: "+err.Error())
+	}
+	response, err := getAdsByConditions(condition, unknownGeneration)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid condition: "+err.Error())
+	}
+
+	var result = &adpb.SearchAdsResponse{
+		Total:      int32(response.Total),
+		Offset:     int32(response.Offset),
+		Limit:      int32(response.Limit),
+		HasMore:    response.HasMore,
+		NextCursor: response.NextCursor,
+	}
+	for _, item := range response.Items {
+		result.Items = append(result.Items, &adpb.SearchResult{Title: item.Title, EndAt: timestamppb.New(item.EndAt), Token: item.Token})
+	}
+	return result, nil
+}
+
+func (adServer) CreateAd(ctx context.Context, req *adpb.CreateAdRequest) (*adpb.CreateAdResponse, error) {
+	if req.Ad == nil {
+		return nil, status.Error(codes.InvalidArgument, "ad is required")
+	}
+	id, err := createAd(adFromProto(req.Ad))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &adpb.CreateAdResponse{Id: id}, nil
+}
+
+func (adServer) GetAd(ctx context.Context, req *adpb.GetAdRequest) (*adpb.Ad, error) {
+	if _, err := uuid.Parse(req.Id); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Id value is invalid")
+	}
+	ad, found, err := getAdByUUID(req.Id)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if !found {
+		return nil, status.Error(codes.NotFound, "Ad not found")
+	}
+	return adToProto(ad), nil
+}
+
+func (adServer) ListAds(ctx context.Context, req *adpb.ListAdsRequest) (*adpb.ListAdsResponse, error) {
+	pageSize := int(req.PageSize)
+	if pageSize == 0 {
+		pageSize = defaultListPageSize
+	}
+	if pageSize < 0 || pageSize > maxListPageSize {
+		return nil, status.Error(codes.InvalidArgument, "Page size value is invalid")
+	}
+	//Page token is the last id of previous page
+	if _, err := uuid.Parse(req.PageToken); req.PageToken != "" && err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Page token value is invalid")
+	}
+	ads, err := listUnexpiredAds(getNowTime(), req.PageToken, pageSize)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	var result = &adpb.ListAdsResponse{}
+	for _, ad := range ads {
+		result.Ads = append(result.Ads, adToProto(ad))
+	}
+	if len(ads) == pageSize {
+		result.NextPageToken = ads[len(ads)-1].UUID
+	}
+	return result, nil
+}
+
+func valuesFromProto(values map[string]*adpb.Values) map[string][]string {
+	if len(values) == 0 {
+		return nil
+	}
+	var result = map[string][]string{}
+	for name, value := range values {
+		result[name] = value.GetValues()
+	}
+	return result
+}
+
+func valuesToProto(values map[string][]string) map[string]*adpb.Values {
+	if len(values) == 0 {
+		return nil
+	}
+	var result = map[string]*adpb.Values{}
+	for name, value := range values {
+		result[name] = &adpb.Values{Values: value}
+	}
+	return result
+}
+
+// Missing timestamp is zero time, AsTime would make it 1970-01-01 and pass validation
+func timeFromProto(t *timestamppb.Timestamp) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return t.AsTime()
+}
+
+func adFromProto(p *adpb.Ad) Ad {
+	ad := Ad{
+		UUID:     p.Id,
+		Title:    p.Title,
+		StartAt:  timeFromProto(p.StartAt),
+		EndAt:    timeFromProto(p.EndAt),
+		Priority: int(p.Priority),
+		FrequencyCap: FrequencyCap{
+			Max:    int(p.FrequencyCap.GetMax()),
+			Period: p.FrequencyCap.GetPeriod(),
+		},
+		Budget: AdBudget{
+			Total:  p.Budget.GetTotal(),
+			Daily:  p.Budget.GetDaily(),
+			Pacing: p.Budget.GetPacing(),
+		},
+		Schedule: AdSchedule{
+			Timezone: p.Schedule.GetTimezone(),
+			Days:     p.Schedule.GetDays(),
+		},
+	}
+	for _, hours := range p.Schedule.GetHours() {
+		ad.Schedule.Hours = append(ad.Schedule.Hours, ScheduleHours{Start: hours.Start, End: hours.End})
+	}
+	c := p.Conditions
+	ad.Conditions = AdCondition{
+		AgeStart:         int(c.GetAgeStart()),
+		AgeEnd:           int(c.GetAgeEnd()),
+		Gender:           c.GetGender(),
+		Countries:        c.GetCountry(),
+		Platforms:        c.GetPlatform(),
+		ExcludeCountries: c.GetExcludeCountry(),
+		ExcludePlatforms: c.GetExcludePlatform(),
+		Targeting:        valuesFromProto(c.GetTargeting()),
+	}
+	for _, r := range c.GetAgeRanges() {
+		var ageRange AgeRange
+		if r.Min != nil {
+			min := int(*r.Min)
+			ageRange.Min = &min
+		}
+		if r.Max != nil {
+			max := int(*r.Max)
+			ageRange.Max = &max
+		}
+		ad.Conditions.AgeRanges = append(ad.Conditions.AgeRanges, ageRange)
+	}
+	return ad
+}
+
+func adToProto(ad Ad) *adpb.Ad {
+	p := &adpb.Ad{
+		Id:           ad.UUID,
+		Title:        ad.Title,
+		StartAt:      timestamppb.New(ad.StartAt),
+		EndAt:        timestamppb.New(ad.EndAt),
+		Priority:     int32(ad.Priority),
+		FrequencyCap: &adpb.FrequencyCap{Max: int32(ad.FrequencyCap.Max), Period: ad.FrequencyCap.Period},
+		Budget:       &adpb.Budget{Total: ad.Budget.Total, Daily: ad.Budget.Daily, Pacing: ad.Budget.Pacing},
+		Schedule:     &adpb.Schedule{Timezone: ad.Schedule.Timezone, Days: ad.Schedule.Days},
+		Conditions: &adpb.Conditions{
+			AgeStart:        int32(ad.Conditions.AgeStart),
+			AgeEnd:          int32(ad.Conditions.AgeEnd),
+			Gender:          ad.Conditions.Gender,
+			Country:         ad.Conditions.Countries,
+			Platform:        ad.Conditions.Platforms,
+			ExcludeCountry:  ad.Conditions.ExcludeCountries,
+			ExcludePlatform: ad.Conditions.ExcludePlatforms,
+			Targeting:       valuesToProto(ad.Conditions.Targeting),
+		},
+	}
+	for _, hours := range ad.Schedule.Hours {
+		p.Schedule.Hours = append(p.Schedule.Hours, &adpb.ScheduleHours{Start: hours.Start, End: hours.End})
+	}
+	for _, r := range ad.Conditions.AgeRanges {
+		var ageRange adpb.AgeRange
+		if r.Min != nil {
+			min := int32(*r.Min)
+			ageRange.Min = &min
+		}
+		if r.Max != nil {
+			max := int32(*r.Max)
+			ageRange.Max = &max
+		}
+		p.Conditions.AgeRanges = append(p.Conditions.AgeRanges, &ageRange)
+	}
+	return p
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Smaller bodies are sent uncompressed, gzip framing would outweigh the savings
+const minCompressSize = 512
+
+// Search response body as it is written, with what its caching headers need
+type encodedPage struct {
+	body []byte
+	//Empty until compressed
+	gzipBody []byte
+	etag     string
+	expireAt time.Time
+	volatile bool
+}
+
+func encodePage(response SearchResponse) encodedPage {
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(response)
+	return encodedPage{
+		body:     body.Bytes(),
+		etag:     searchETag(response.generation, body.Bytes()),
+		expireAt: response.expireAt,
+		volatile: response.volatile,
+	}
+}
+
+func (page *encodedPage) compress() {
+	if len(page.gzipBody) > 0 || len(page.body) < minCompressSize {
+		return
+	}
+	var compressed bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&compressed, gzip.DefaultCompression)
+	writer.Write(page.body)
+	writer.Close()
+	page.gzipBody = compressed.Bytes()
+}
+
+// Cache-Control of a search response.
+// Results stay the same until the cached entry expires, unless something decided per request can change them:
+// results depending on budget or frequency counters and random rankings need the server every time.
+// Every response carries tokens counted once per serve, so shared caches must not replay it to other clients.
+func searchCacheControl(condition SearchCondition, page encodedPage, now time.Time) string {
+	if randomRankings[condition.Sort] {
+		return "no-store"
+	}
+	if page.volatile {
+		return "private, no-cache"
+	}
+	maxAge := int(page.expireAt.Sub(now) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	return "private, max-age=" + strconv.Itoa(maxAge)
+}
+
+// Strong ETag of the cache generation and the exact response body
+func searchETag(generation int64, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d:", generation)
+	hash.Write(body)
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// Whether If-None-Match lists etag, compared weakly as RFC 9110 requires for If-None-Match
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether Accept-Encoding allows gzip, an explicit q=0 refuses it
+func acceptsGzip(acceptEncoding string) bool {
+	accepted := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(value, 64)
+		}
+		if coding == "gzip" {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// Write page in the encoding client accepts, or 304 when client has the same body.
+// Each encoding has its own strong ETag.
+func writeEncodedPage(w http.ResponseWriter, r *http.Request, condition SearchCondition, page *encodedPage) {
+	body, etag := page.body, page.etag
+	w.Header().Set("Vary", "Accept-Encoding")
+	if acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		page.compress()
+		if len(page.gzipBody) > 0 {
+			body = page.gzipBody
+			etag = strings.TrimSuffix(page.etag, `"`) + `-gzip"`
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+	}
+
+	cacheControl := searchCacheControl(condition, *page, getNowTime())
+	w.Header().Set("Cache-Control", cacheControl)
+	if cacheControl != "no-store" {
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Del("Content-Encoding")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
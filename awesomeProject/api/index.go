@@ -0,0 +1,373 @@
+package api
+
+import (
+	"log"
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Set when public api serves from memory instead of cache and database
+var servingIndex *adIndex
+
+// How often serving index moves started and expired ads in and out
+var indexRebuildInterval = time.Duration(getEnvInt("AD_INDEX_REBUILD_MS", 1000)) * time.Millisecond
+
+// One bit per ad, bit i is ads[i] of the index
+type bitmap []uint64
+
+func newBitmap(size int) bitmap {
+	return make(bitmap, (size+63)/64)
+}
+
+func (b bitmap) set(i int) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b bitmap) clear(i int) {
+	b[i/64] &^= 1 << (i % 64)
+}
+
+func (b bitmap) or(other bitmap) {
+	for i := range b {
+		b[i] |= other[i]
+	}
+}
+
+func (b bitmap) and(other bitmap) {
+	for i := range b {
+		b[i] &= other[i]
+	}
+}
+
+func (b bitmap) andNot(other bitmap) {
+	for i := range b {
+		b[i] &^= other[i]
+	}
+}
+
+// Posting lists of one targeting field, ads without condition on this field match every value except excluded ones
+type postings struct {
+	any      bitmap
+	values   map[string]bitmap
+	excluded map[string]bitmap
+}
+
+func newPostings(size int) *postings {
+	return &postings{any: newBitmap(size), values: map[string]bitmap{}, excluded: map[string]bitmap{}}
+}
+
+func (p *postings) add(i int, size int, values []string) {
+	if len(values) == 0 {
+		p.any.set(i)
+		return
+	}
+	for _, value := range values {
+		if p.values[value] == nil {
+			p.values[value] = newBitmap(size)
+		}
+		p.values[value].set(i)
+	}
+}
+
+func (p *postings) exclude(i int, size int, values []string) {
+	for _, value := range values {
+		if p.excluded[value] == nil {
+			p.excluded[value] = newBitmap(size)
+		}
+		p.excluded[value].set(i)
+	}
+}
+
+// Clear ad i from every list, values are the ones it was added and excluded with
+func (p *postings) remove(i int, values []string, excluded []string) {
+	p.any.clear(i)
+	for _, value := range values {
+		if posting, ok := p.values[value]; ok {
+			posting.clear(i)
+		}
+	}
+	for _, value := range excluded {
+		if posting, ok := p.excluded[value]; ok {
+			posting.clear(i)
+		}
+	}
+}
+
+// Ads matching any of the values
+func (p *postings) match(values []string) bitmap {
+	result := newBitmap(len(p.any) * 64)
+	for _, value := range values {
+		matched := newBitmap(len(p.any) * 64)
+		matched.or(p.any)
+		if posting, ok := p.values[value]; ok {
+			matched.or(posting)
+		}
+		if posting, ok := p.excluded[value]; ok {
+			matched.andNot(posting)
+		}
+		result.or(matched)
+	}
+	return result
+}
+
+// In-memory inverted index of active ads
+type adIndex struct {
+	mu sync.RWMutex
+
+	//All loaded ads that have not expired, including ones not started yet
+	loaded map[string]Ad
+
+	//Active ads by slot and their posting lists, slots of removed ads are reused.
+	//Bitmaps have room for capacity slots, the index is built again when it runs out.
+	//Generation changes whenever the active set or an active ad does.
+	generation int64
+	ads        []Ad
+	slots      map[string]int
+	free       []int
+	capacity   int
+	active     bitmap
+	//Posting lists of built-in dimensions by name
+	postings map[string]*postings
+}
+
+func newAdIndex() *adIndex {
+	index := &adIndex{loaded: map[string]Ad{}}
+	index.build(nil)
+	return index
+}
+
+// Load every unexpired ad from database, replacing the ones loaded before
+func (index *adIndex) load() error {
+	now := getNowTime()
+	ads, err := getUnexpiredAds(now)
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]Ad, len(ads))
+	for _, ad := range ads {
+		loaded[ad.UUID] = ad
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	index.loaded = loaded
+	index.rebuild(now)
+	return nil
+}
+
+// Change feed subscriber, re-reads the changed ad from database
+func (index *adIndex) apply(change adChange) error {
+	ad, found, err := getAdByUUID(change.UUID)
+	if err != nil {
+		return err
+	}
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if found && change.Op != adDeleted {
+		index.loaded[ad.UUID] = ad
+	} else {
+		delete(index.loaded, change.UUID)
+	}
+	index.refresh(change.UUID, getNowTime())
+	return nil
+}
+
+// Re-index one loaded ad, caller holds write lock
+func (index *adIndex) refresh(id string, now time.Time) {
+	ad, ok := index.loaded[id]
+	if ok && !ad.EndAt.Before(now) && !ad.StartAt.After(now) {
+		index.put(ad)
+	} else if _, ok := index.slots[id]; ok {
+		index.remove(id)
+		index.generation++
+	}
+}
+
+// Ads start and expire without any change, move them in and out on a timer until process exits
+func (index *adIndex) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		index.mu.Lock()
+		index.expire(getNowTime())
+		index.mu.Unlock()
+	}
+}
+
+// Drop expired ads and index the active ones from scratch, caller holds write lock
+func (index *adIndex) rebuild(now time.Time) {
+	var active []Ad
+	for id, ad := range index.loaded {
+		if ad.EndAt.Before(now) {
+			delete(index.loaded, id)
+			continue
+		}
+		if !ad.StartAt.After(now) {
+			active = append(active, ad)
+		}
+	}
+	index.build(active)
+}
+
+// Drop expired ads and re-index only the ones that started or expired since last call, caller holds write lock
+func (index *adIndex) expire(now time.Time) {
+	for id, ad := range index.loaded {
+		_, indexed := index.slots[id]
+		if ad.EndAt.Before(now) {
+			delete(index.loaded, id)
+		}
+		if indexed != (!ad.EndAt.Before(now) && !ad.StartAt.After(now)) {
+			index.refresh(id, now)
+		}
+	}
+}
+
+func (index *adIndex) build(active []Ad) {
+	if !sameAds(index.slots, active) {
+		index.generation++
+	}
+	index.reindex(active)
+}
+
+// Index active ads into fresh slots with room for as many more
+func (index *adIndex) reindex(active []Ad) {
+	index.capacity = max(64, 2*len(active))
+	index.ads = nil
+	index.slots = make(map[string]int, len(active))
+	index.free = nil
+	index.active = newBitmap(index.capacity)
+	index.postings = make(map[string]*postings, len(builtinDimensions))
+	for _, dimension := range builtinDimensions {
+		index.postings[dimension.name] = newPostings(index.capacity)
+	}
+	for _, ad := range active {
+		index.insert(ad)
+	}
+}
+
+func sameAds(slots map[string]int, ads []Ad) bool {
+	if len(slots) != len(ads) {
+		return false
+	}
+	for _, ad := range ads {
+		if _, ok := slots[ad.UUID]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Index a new or changed active ad
+func (index *adIndex) put(ad Ad) {
+	if _, ok := index.slots[ad.UUID]; ok {
+		index.remove(ad.UUID)
+	}
+	index.generation++
+	if len(index.free) == 0 && len(index.ads) == index.capacity {
+		active := make([]Ad, 0, len(index.slots)+1)
+		for _, i := range index.slots {
+			active = append(active, index.ads[i])
+		}
+		index.reindex(append(active, ad))
+		return
+	}
+	index.insert(ad)
+}
+
+// Set bits of an ad in a free slot, there must be one
+func (index *adIndex) insert(ad Ad) {
+	var i int
+	if n := len(index.free); n > 0 {
+		i = index.free[n-1]
+		index.free = index.free[:n-1]
+		index.ads[i] = ad
+	} else {
+		i = len(index.ads)
+		index.ads = append(index.ads, ad)
+	}
+	index.slots[ad.UUID] = i
+	index.active.set(i)
+	for _, dimension := range builtinDimensions {
+		posting := index.postings[dimension.name]
+		posting.add(i, index.capacity, dimension.adValues(ad.Conditions))
+		if dimension.excluded != nil {
+			posting.exclude(i, index.capacity, dimension.excluded(ad.Conditions))
+		}
+	}
+}
+
+// Clear bits of an indexed ad and free its slot, callers bump generation
+func (index *adIndex) remove(id string) {
+	i := index.slots[id]
+	ad := index.ads[i]
+	index.active.clear(i)
+	for _, dimension := range builtinDimensions {
+		var excluded []string
+		if dimension.excluded != nil {
+			excluded = dimension.excluded(ad.Conditions)
+		}
+		index.postings[dimension.name].remove(i, dimension.adValues(ad.Conditions), excluded)
+	}
+	index.ads[i] = Ad{}
+	delete(index.slots, id)
+	index.free = append(index.free, i)
+}
+
+// Age posting keys of an ad, none means every age
+func ageValues(condition AdCondition) []string {
+	var values []string
+	for _, ageRange := range condition.ageRanges() {
+		for age := ageRange.lower(); age <= ageRange.upper(); age++ {
+			values = append(values, strconv.Itoa(age))
+		}
+	}
+	return values
+}
+
+// Active ads matching condition sorted by EndAt, and index generation
+func (index *adIndex) search(condition SearchCondition, now time.Time) ([]Ad, int64) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	result := newBitmap(index.capacity)
+	result.or(index.active)
+	for _, dimension := range builtinDimensions {
+		if values := *dimension.queryValues(&condition); len(values) > 0 {
+			result.and(index.postings[dimension.name].match(values))
+		}
+	}
+
+	//Ads expired since last rebuild are skipped
+	var ads = []Ad{}
+	for word, value := range result {
+		for value != 0 {
+			i := word*64 + bits.TrailingZeros64(value)
+			value &= value - 1
+			if index.ads[i].EndAt.Before(now) {
+				continue
+			}
+			ads = append(ads, index.ads[i])
+		}
+	}
+	//Slots are in insertion order
+	sort.Slice(ads, func(i, j int) bool {
+		return adBefore(ads[i].EndAt, ads[i].UUID, ads[j])
+	})
+	return filterTargeting(ads, condition.Targeting), index.generation
+}
+
+// Load all ads into serving index and keep it in sync through change feed.
+// Feed position is taken before loading, changes in between are applied twice which is harmless.
+func startServingIndex(feed *changeFeed) {
+	index := newAdIndex()
+	err := index.load()
+	if err != nil {
+		log.Fatal("Cannot load serving index: ", err)
+	}
+	feed.subscribe(index.apply, index.load)
+	go index.run(indexRebuildInterval)
+	servingIndex = index
+}
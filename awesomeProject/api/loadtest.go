@@ -0,0 +1,393 @@
+package api
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Share of traffic by country and platform, skewed like a regional app with a long tail abroad
+var (
+	loadTestCountries = map[string]float64{"TW": 40, "JP": 12, "US": 10, "HK": 8, "KR": 6, "SG": 5, "MY": 4, "TH": 3, "VN": 3, "ID": 2, "PH": 2, "AU": 2, "GB": 1.5, "DE": 1, "CA": 0.5}
+	loadTestPlatforms = map[string]float64{"ios": 45, "android": 40, "web": 15}
+)
+
+type loadTestConfig struct {
+	target      string
+	rps         int
+	duration    time.Duration
+	concurrency int
+	//Share of queries drawn uniformly from every condition, most of them miss the cache
+	tailShare float64
+	//Share of queries with a userId, their pages are not shared
+	userShare float64
+	seed      int64
+}
+
+// Weighted random choice, values are sorted so the same seed gives the same sequence
+type weightedChoice struct {
+	values     []string
+	cumulative []float64
+}
+
+func newWeightedChoice(weights map[string]float64) weightedChoice {
+	var choice weightedChoice
+	for value := range weights {
+		choice.values = append(choice.values, value)
+	}
+	sort.Strings(choice.values)
+	total := 0.0
+	for _, value := range choice.values {
+		total += weights[value]
+		choice.cumulative = append(choice.cumulative, total)
+	}
+	return choice
+}
+
+func (c weightedChoice) pick(rng *rand.Rand) string {
+	x := rng.Float64() * c.cumulative[len(c.cumulative)-1]
+	return c.values[sort.SearchFloat64s(c.cumulative, x)]
+}
+
+// Public search queries of a load test
+type queryMix struct {
+	config    loadTestConfig
+	countries weightedChoice
+	platforms weightedChoice
+	//Every country for the long tail
+	allCountries []string
+}
+
+func newQueryMix(config loadTestConfig) queryMix {
+	mix := queryMix{config: config, countries: newWeightedChoice(loadTestCountries), platforms: newWeightedChoice(loadTestPlatforms)}
+	for _, country := range iso3166Countries {
+		mix.allCountries = append(mix.allCountries, country.Alpha2)
+	}
+	return mix
+}
+
+// Query params of the next request.
+// Most queries come from a few popular combinations, ages around 27, and ask for the first page.
+func (m queryMix) next(rng *rand.Rand) url.Values {
+	query := url.Values{}
+	if rng.Float64() < m.config.tailShare {
+		query.Set("age", strconv.Itoa(minAge+rng.Intn(maxAge-minAge+1)))
+		query.Set("country", m.allCountries[rng.Intn(len(m.allCountries))])
+		query.Set("platform", []string{"android", "ios", "web"}[rng.Intn(3)])
+		query.Set("gender", []string{"M", "F"}[rng.Intn(2)])
+		query.Set("limit", strconv.Itoa(1+rng.Intn(20)))
+		return query
+	}
+
+	if rng.Float64() < 0.8 {
+		age := int(math.Round(rng.NormFloat64()*8 + 27))
+		age = max(minAge, min(maxAge, age))
+		query.Set("age", strconv.Itoa(age))
+	}
+	if rng.Float64() < 0.6 {
+		query.Set("gender", []string{"M", "F"}[rng.Intn(2)])
+	}
+	if rng.Float64() < 0.9 {
+		query.Set("country", m.countries.pick(rng))
+	}
+	if rng.Float64() < 0.9 {
+		query.Set("platform", m.platforms.pick(rng))
+	}
+	if rng.Float64() < 0.1 {
+		query.Set("offset", strconv.Itoa(5*(1+rng.Intn(2))))
+	}
+	if rng.Float64() < m.config.userShare {
+		query.Set("userId", "loadtest-user-"+strconv.Itoa(rng.Intn(10000)))
+	}
+	return query
+}
+
+// Titles of synthetic ads start with the id of their run, -cleanup deletes only the ads of that run
+func loadTestTitlePrefix(run string) string {
+	return "[loadtest " + run + "] "
+}
+
+// Run ids are letters and digits, so no other run's prefix or real title starts with one by accident
+func isValidLoadTestRun(run string) bool {
+	if run == "" {
+		return false
+	}
+	for _, c := range run {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Ad with the same skew as queries, so popular queries match many ads
+func syntheticAd(rng *rand.Rand, mix queryMix, run string, i int, now time.Time) Ad {
+	ad := Ad{
+		Title:    fmt.Sprintf("%sad %d", loadTestTitlePrefix(run), i),
+		StartAt:  now.Add(-time.Duration(rng.Int63n(int64(7 * 24 * time.Hour)))),
+		EndAt:    now.Add(time.Hour + time.Duration(rng.Int63n(int64(30*24*time.Hour)))),
+		Priority: rng.Intn(10),
+	}
+	if rng.Float64() < 0.7 {
+		ad.Conditions.AgeStart = 13 + rng.Intn(30)
+		ad.Conditions.AgeEnd = min(maxAge, ad.Conditions.AgeStart+5+rng.Intn(30))
+	}
+	if rng.Float64() < 0.3 {
+		ad.Conditions.Gender = []string{[]string{"M", "F"}[rng.Intn(2)]}
+	}
+	if rng.Float64() < 0.8 {
+		ad.Conditions.Countries = pickDistinct(rng, mix.countries, 1+rng.Intn(3))
+	}
+	if rng.Float64() < 0.7 {
+		ad.Conditions.Platforms = pickDistinct(rng, mix.platforms, 1+rng.Intn(2))
+	}
+	return ad
+}
+
+func pickDistinct(rng *rand.Rand, choice weightedChoice, n int) []string {
+	var values []string
+	picked := map[string]bool{}
+	for i := 0; i < n*4 && len(values) < n; i++ {
+		value := choice.pick(rng)
+		if !picked[value] {
+			picked[value] = true
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Save n synthetic ads of a run through the store and clear the cache once, quotas still apply
+func seedLoadTestAds(n int, mix queryMix, seed int64, run string) error {
+	rng := rand.New(rand.NewSource(seed))
+	now := getNowTime()
+	for i := 0; i < n; i++ {
+		ad := syntheticAd(rng, mix, run, i, now)
+		err := validateAd(ad)
+		if err != nil {
+			return err
+		}
+		_, err = saveAd(ad)
+		if err != nil {
+			return fmt.Errorf("ad %d: %w", i, err)
+		}
+	}
+	clearSearchHistory()
+	return nil
+}
+
+type loadTestResult struct {
+	sent      int
+	dropped   int
+	failed    int
+	cacheHits int
+	//Responses with X-Cache, servers without it report no hit ratio
+	cacheReported int
+	statuses      map[string]int
+	latencies     []time.Duration
+	elapsed       time.Duration
+}
+
+// Request of a load test and when the fixed rate schedule wanted it sent
+type loadTestJob struct {
+	target      string
+	scheduledAt time.Time
+}
+
+// Send queries of mix to target at config.rps for config.duration.
+// Requests are scheduled at a fixed rate whatever the latency, requests no worker is free for are dropped and reported.
+// Latency counts from the scheduled time, so waiting for a free worker is part of it.
+func runLoadTest(config loadTestConfig, mix queryMix) loadTestResult {
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: config.concurrency, MaxConnsPerHost: config.concurrency},
+	}
+	jobs := make(chan loadTestJob, config.concurrency)
+	results := make([]loadTestResult, config.concurrency)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(result *loadTestResult) {
+			defer wg.Done()
+			result.statuses = map[string]int{}
+			for job := range jobs {
+				sendLoadTestRequest(client, job, result)
+			}
+		}(&results[i])
+	}
+
+	rng := rand.New(rand.NewSource(config.seed))
+	total := loadTestResult{statuses: map[string]int{}}
+	start := time.Now()
+	ticker := time.NewTicker(5 * time.Millisecond)
+	for now := range ticker.C {
+		elapsed := now.Sub(start)
+		if elapsed > config.duration {
+			elapsed = config.duration
+		}
+		due := int(elapsed.Seconds()*float64(config.rps)) - total.sent - total.dropped
+		for i := 0; i < due; i++ {
+			scheduledAt := start.Add(time.Duration(total.sent+total.dropped) * time.Second / time.Duration(config.rps))
+			select {
+			case jobs <- loadTestJob{target: config.target + "/api/v2/ad?" + mix.next(rng).Encode(), scheduledAt: scheduledAt}:
+				total.sent++
+			default:
+				total.dropped++
+			}
+		}
+		if elapsed == config.duration {
+			break
+		}
+	}
+	ticker.Stop()
+	close(jobs)
+	wg.Wait()
+	total.elapsed = time.Since(start)
+
+	for _, result := range results {
+		total.failed += result.failed
+		total.cacheHits += result.cacheHits
+		total.cacheReported += result.cacheReported
+		total.latencies = append(total.latencies, result.latencies...)
+		for status, count := range result.statuses {
+			total.statuses[status] += count
+		}
+	}
+	sort.Slice(total.latencies, func(i, j int) bool { return total.latencies[i] < total.latencies[j] })
+	return total
+}
+
+func sendLoadTestRequest(client *http.Client, job loadTestJob, result *loadTestResult) {
+	request, _ := http.NewRequest("GET", job.target, nil)
+	//Set explicitly so the body is read as sent, not decompressed
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := client.Do(request)
+	if err != nil {
+		result.failed++
+		result.statuses["error"]++
+		return
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	result.latencies = append(result.latencies, time.Since(job.scheduledAt))
+	result.statuses[strconv.Itoa(response.StatusCode)]++
+	if response.StatusCode >= 400 {
+		result.failed++
+	}
+	switch response.Header.Get("X-Cache") {
+	case "HIT":
+		result.cacheHits++
+		result.cacheReported++
+	case "MISS":
+		result.cacheReported++
+	}
+}
+
+// Latency below which p of sorted latencies are, nearest rank
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(0, min(len(sorted)-1, rank))]
+}
+
+func (r loadTestResult) report(w io.Writer) {
+	completed := r.sent - r.statuses["error"]
+	fmt.Fprintf(w, "Requests:   %d sent, %d dropped, %d completed in %.1fs (%.0f req/s)\n", r.sent, r.dropped, completed, r.elapsed.Seconds(), float64(completed)/r.elapsed.Seconds())
+	var statuses []string
+	for status := range r.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	var counts []string
+	for _, status := range statuses {
+		counts = append(counts, fmt.Sprintf("%s: %d", status, r.statuses[status]))
+	}
+	errorRate := 0.0
+	if r.sent > 0 {
+		errorRate = float64(r.failed) / float64(r.sent) * 100
+	}
+	fmt.Fprintf(w, "Errors:     %d (%.2f%%), %s\n", r.failed, errorRate, strings.Join(counts, ", "))
+	fmt.Fprintf(w, "Latency:    p50 %v, p90 %v, p95 %v, p99 %v, p99.9 %v, max %v\n",
+		percentile(r.latencies, 50), percentile(r.latencies, 90), percentile(r.latencies, 95),
+		percentile(r.latencies, 99), percentile(r.latencies, 99.9), percentile(r.latencies, 100))
+	if r.cacheReported > 0 {
+		fmt.Fprintf(w, "Cache hits: %.1f%% of %d responses\n", float64(r.cacheHits)/float64(r.cacheReported)*100, r.cacheReported)
+	} else {
+		fmt.Fprintln(w, "Cache hits: not reported by server")
+	}
+}
+
+// Entry point of `main loadtest`.
+// Without -target the api is served in process from the local Redis and Postgres, only then ads can be seeded into its store.
+func LoadTest(args []string) {
+	config := loadTestConfig{}
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	flags.StringVar(&config.target, "target", "", "Base URL of a running server, e.g. http://localhost:8080, empty serves the api in process")
+	flags.IntVar(&config.rps, "rps", 10000, "Requests per second")
+	flags.DurationVar(&config.duration, "duration", 30*time.Second, "How long to send requests")
+	flags.IntVar(&config.concurrency, "concurrency", 500, "Requests in flight at most")
+	flags.Float64Var(&config.tailShare, "tail", 0.05, "Share of queries drawn uniformly from every condition")
+	flags.Float64Var(&config.userShare, "users", 0.1, "Share of queries with a userId")
+	flags.Int64Var(&config.seed, "seed", 1, "Random seed of ads and queries")
+	seedAds := flags.Int("ads", 0, "Synthetic ads to save before the test, AD_MAX_ACTIVE_ADS and AD_MAX_DAILY_CREATED_ADS must allow them")
+	cleanup := flags.Bool("cleanup", false, "Delete synthetic ads of the run after the test, they count against quotas until deleted")
+	run := flags.String("run", "", "Id of the run synthetic ads are tagged with, random when empty, pass an earlier run's id to clean up its ads")
+	flags.Parse(args)
+	if config.rps <= 0 || config.concurrency <= 0 || config.duration <= 0 {
+		log.Fatal("rps, concurrency and duration must be positive")
+	}
+	if *run == "" {
+		*run = newRandomSeed()
+	}
+	if !isValidLoadTestRun(*run) {
+		log.Fatal("run can only have letters and digits")
+	}
+	//A remote server reads its own store, ads seeded here would never reach it
+	if config.target != "" && (*seedAds > 0 || *cleanup) {
+		log.Fatal("-ads and -cleanup only work without -target, seed a remote server through its admin api")
+	}
+
+	mix := newQueryMix(config)
+	if config.target == "" {
+		setConnections()
+	}
+	if *seedAds > 0 {
+		err := seedLoadTestAds(*seedAds, mix, config.seed, *run)
+		if err != nil {
+			log.Fatal("Cannot seed ads: ", err)
+		}
+		println("Seeded ads: ", *seedAds, " run: ", *run)
+	}
+	if config.target == "" {
+		startChangeFeed(os.Getenv("AD_SERVING_INDEX") != "")
+		server := httptest.NewServer(newRouter())
+		defer server.Close()
+		config.target = server.URL
+	}
+
+	println("Sending", config.rps, "req/s to", config.target, "for", config.duration.String())
+	runLoadTest(config, mix).report(os.Stdout)
+
+	if *cleanup {
+		deleted, err := deleteAdsByTitlePrefix(loadTestTitlePrefix(*run))
+		if err != nil {
+			log.Fatal("Cannot delete synthetic ads: ", err)
+		}
+		clearSearchHistory()
+		println("Deleted ads: ", deleted)
+	}
+}
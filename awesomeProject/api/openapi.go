@@ -0,0 +1,308 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenAPI 3 document of the http api.
+// Schemas are generated from the Go types by their json tags, so they cannot drift from what handlers encode and decode.
+var openAPIDocument = sync.OnceValue(buildOpenAPIDocument)
+
+type openAPISchemas struct {
+	components map[string]interface{}
+}
+
+// Schema of a Go type, named structs become components.
+// Response types list fields without omitempty as required and allow no other fields,
+// request types leave required fields to validation and ignore unknown ones.
+func (s *openAPISchemas) schemaOf(t reflect.Type, response bool) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := s.schemaOf(t.Elem(), response)
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": s.schemaOf(t.Elem(), response), "nullable": true}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schemaOf(t.Elem(), response), "nullable": true}
+	case reflect.Struct:
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := s.components[name]; !ok {
+			//Placeholder first, types may refer to themselves
+			s.components[name] = nil
+			s.components[name] = s.structSchema(t, response)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (s *openAPISchemas) structSchema(t reflect.Type, response bool) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if field.Anonymous && tag == "" {
+				addFields(field.Type)
+				continue
+			}
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = s.schemaOf(field.Type, response)
+			if response && !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if response {
+		sort.Strings(required)
+		schema["required"] = required
+		schema["additionalProperties"] = false
+	}
+	return schema
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func itemsOf(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           map[string]interface{}{"items": map[string]interface{}{"type": "array", "items": schema}},
+		"required":             []string{"items"},
+		"additionalProperties": false,
+	}
+}
+
+// Error responses are plain text
+func errorResponse(description string) map[string]interface{} {
+	return map[string]interface{}{"description": description, "content": map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}}
+}
+
+func okResponse(description string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"description": description, "content": jsonContent(schema)}
+}
+
+func queryParam(name string, schema map[string]interface{}, description string) map[string]interface{} {
+	return map[string]interface{}{"name": name, "in": "query", "schema": schema, "description": description}
+}
+
+func buildOpenAPIDocument() map[string]interface{} {
+	s := &openAPISchemas{components: map[string]interface{}{}}
+	str := map[string]interface{}{"type": "string"}
+	strArray := map[string]interface{}{"type": "array", "items": str}
+
+	var sorts []string
+	for name := range rankingStrategies {
+		sorts = append(sorts, name)
+	}
+	sort.Strings(sorts)
+	searchParams := []interface{}{
+		queryParam("offset", map[string]interface{}{"type": "integer", "minimum": 0, "default": 0}, "Ads to skip, ignored with cursor"),
+		queryParam("limit", map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 100, "default": 5}, "Page size"),
+		queryParam("userId", str, "User for frequency capping, at most 128 characters"),
+		queryParam("deviceId", str, "Used as userId when userId is missing"),
+		queryParam("sort", map[string]interface{}{"type": "string", "enum": sorts, "default": defaultRanking}, "Ranking strategy"),
+		queryParam("cursor", str, "nextCursor of previous page"),
+		queryParam("infer", map[string]interface{}{"type": "boolean"}, "Infer missing country from client IP and platform from User-Agent"),
+		queryParam("age", map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "integer", "minimum": minAge, "maximum": maxAge}}, ""),
+		queryParam("gender", map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string", "enum": []string{"M", "F"}}}, ""),
+		queryParam("country", strArray, "ISO 3166 alpha-2 or alpha-3 codes"),
+		queryParam("platform", map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string", "enum": []string{"android", "ios", "web"}}}, ""),
+	}
+	var dimensions []string
+	for name := range targetingDimensions {
+		dimensions = append(dimensions, name)
+	}
+	sort.Strings(dimensions)
+	for _, name := range dimensions {
+		searchParams = append(searchParams, queryParam(name, strArray, "Targeting dimension"))
+	}
+	idParam := map[string]interface{}{"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string", "format": "uuid"}}
+	tokenParam := queryParam("token", str, "Token of search result, may be sent in JSON body instead")
+	serveParam := queryParam("serve", str, serveTokenHeader+" header of the search response, required with tokens of anonymous pages")
+	trackingBody := map[string]interface{}{"content": jsonContent(map[string]interface{}{"type": "object", "properties": map[string]interface{}{"token": str, "serve": str}})}
+	message := map[string]interface{}{"type": "object", "properties": map[string]interface{}{"message": str}, "required": []string{"message"}, "additionalProperties": false}
+
+	//Both versions share handlers, v2 takes AdV2 with case-sensitive keys and rejects unknown params
+	apiPaths := func(v2 bool) map[string]interface{} {
+		adType := reflect.TypeOf(Ad{})
+		if v2 {
+			adType = reflect.TypeOf(AdV2{})
+		}
+		paths := map[string]interface{}{
+			"/ad": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Create ad",
+					"requestBody": map[string]interface{}{"required": true, "content": jsonContent(s.schemaOf(adType, false))},
+					"responses": map[string]interface{}{
+						"201": okResponse("Ad created", message),
+						"400": errorResponse("Invalid ad"),
+						"409": errorResponse("Quota exceeded"),
+						"413": errorResponse("Request body too large"),
+						"415": errorResponse("Content-Type is not application/json"),
+						"500": errorResponse("Database error"),
+					},
+				},
+				"get": map[string]interface{}{
+					"summary":    "Search active ads",
+					"parameters": searchParams,
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "Page of matching ads",
+							"content":     jsonContent(s.schemaOf(reflect.TypeOf(SearchResponse{}), true)),
+							"headers": map[string]interface{}{serveTokenHeader: map[string]interface{}{
+								"description": "Sent with tracking tokens of anonymous pages, new for every response",
+								"schema":      str,
+							}},
+						},
+						"304": map[string]interface{}{"description": "Same page as the ETag in If-None-Match"},
+						"400": errorResponse("Invalid param"),
+					},
+				},
+			},
+			"/ad/search": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Search active ads with conditions in body, or several placements at once",
+					"requestBody": map[string]interface{}{"required": true, "content": jsonContent(s.schemaOf(reflect.TypeOf(searchBody{}), false))},
+					"responses": map[string]interface{}{
+						"200": okResponse("Page of matching ads, or pages by placement", map[string]interface{}{"oneOf": []interface{}{
+							s.schemaOf(reflect.TypeOf(SearchResponse{}), true),
+							s.schemaOf(reflect.TypeOf(BatchSearchResponse{}), true),
+						}}),
+						"400": errorResponse("Invalid param"),
+					},
+				},
+			},
+			"/ad/{id}/impression": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Record impression",
+					"parameters":  []interface{}{idParam, tokenParam, serveParam},
+					"requestBody": trackingBody,
+					"responses": map[string]interface{}{
+						"202": map[string]interface{}{"description": "Event queued, or ignored when the token or serve token was already reported"},
+						"400": errorResponse("Invalid token"),
+						"503": errorResponse("Too many events"),
+					},
+				},
+			},
+			"/ad/{id}/click": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Record click",
+					"parameters":  []interface{}{idParam, tokenParam, serveParam},
+					"requestBody": trackingBody,
+					"responses": map[string]interface{}{
+						"202": map[string]interface{}{"description": "Event queued, or ignored when the token or serve token was already reported"},
+						"400": errorResponse("Invalid token"),
+						"503": errorResponse("Too many events"),
+					},
+				},
+			},
+			"/report": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary": "Daily impressions and clicks",
+					"parameters": []interface{}{
+						queryParam("adId", map[string]interface{}{"type": "string", "format": "uuid"}, "All ads when missing"),
+						queryParam("from", map[string]interface{}{"type": "string", "format": "date"}, "UTC day, default 6 days before to"),
+						queryParam("to", map[string]interface{}{"type": "string", "format": "date"}, "UTC day, default today"),
+					},
+					"responses": map[string]interface{}{
+						"200": okResponse("Stats by ad and day", itemsOf(s.schemaOf(reflect.TypeOf(AdStats{}), true))),
+						"400": errorResponse("Invalid param"),
+						"500": errorResponse("Database error"),
+					},
+				},
+			},
+			"/country": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary": "ISO 3166 countries",
+					"responses": map[string]interface{}{
+						"200": okResponse("Countries", itemsOf(s.schemaOf(reflect.TypeOf(countryInfo{}), true))),
+					},
+				},
+			},
+			"/country-group": map[string]interface{}{
+				"post": map[string]interface{}{
+					"summary":     "Create or replace custom country group",
+					"requestBody": map[string]interface{}{"required": true, "content": jsonContent(s.schemaOf(reflect.TypeOf(CountryGroup{}), true))},
+					"responses": map[string]interface{}{
+						"201": okResponse("Group saved", s.schemaOf(reflect.TypeOf(CountryGroup{}), true)),
+						"400": errorResponse("Invalid group"),
+						"413": errorResponse("Request body too large"),
+						"415": errorResponse("Content-Type is not application/json"),
+						"500": errorResponse("Database error"),
+					},
+				},
+				"get": map[string]interface{}{
+					"summary": "Built-in and custom country groups",
+					"responses": map[string]interface{}{
+						"200": okResponse("Groups", itemsOf(s.schemaOf(reflect.TypeOf(CountryGroup{}), true))),
+						"500": errorResponse("Database error"),
+					},
+				},
+			},
+		}
+		return paths
+	}
+
+	paths := map[string]interface{}{
+		"/openapi.json": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "This document",
+				"responses": map[string]interface{}{
+					"200": okResponse("OpenAPI document", map[string]interface{}{"type": "object"}),
+				},
+			},
+		},
+	}
+	for path, operations := range apiPaths(false) {
+		for _, operation := range operations.(map[string]interface{}) {
+			operation.(map[string]interface{})["deprecated"] = true
+		}
+		paths["/api/v1"+path] = operations
+	}
+	for path, operations := range apiPaths(true) {
+		paths["/api/v2"+path] = operations
+	}
+
+	return map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       map[string]interface{}{"title": "Ad API", "version": "1.0.0"},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": s.components},
+	}
+}
+
+// Handles GET /openapi.json
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPIDocument())
+}
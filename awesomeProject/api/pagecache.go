@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Pre-serialized public pages live next to cached entries, so clearing the cache removes them too
+const cachePagePrefix = cacheEntryPrefix + "page:"
+
+// Pages are only shared when nothing in them is decided per request.
+// The serving index keeps its own generation per process, so pages are only cached in front of Redis entries.
+func isPageCacheable(condition SearchCondition) bool {
+	return servingIndex == nil && condition.UserID == "" && !randomRankings[condition.Sort]
+}
+
+// Reads generation and the page stored under it in one round trip.
+// KEYS[1] is the generation, the page key is ARGV[1] .. generation .. ARGV[2].
+var cachedPageScript = redis.NewScript(`
+local generation = redis.call("GET", KEYS[1]) or "0"
+return {generation, redis.call("HGETALL", ARGV[1] .. generation .. ARGV[2])}
+`)
+
+// Canonical key of a page, conditions, page position and inferred values all change the body
+func pageCacheKey(condition SearchCondition, inferred map[string]string, generation int64) (string, error) {
+	suffix, err := pageCacheSuffix(condition, inferred)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d%s", cachePagePrefix, generation, suffix), nil
+}
+
+// Part of the page key after generation
+func pageCacheSuffix(condition SearchCondition, inferred map[string]string) (string, error) {
+	conditionJson, err := json.Marshal(condition)
+	if err != nil {
+		return "", err
+	}
+	cursorJson, err := json.Marshal(condition.Cursor)
+	if err != nil {
+		return "", err
+	}
+	inferredJson, err := json.Marshal(inferred)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(":%s:%d:%d:%s:%s:%s", condition.Sort, condition.Offset, condition.Limit, cursorJson, inferredJson, conditionJson), nil
+}
+
+// Cached page of condition and the cache generation it was looked up in.
+// False on miss or when Redis cannot be read, the generation is unknownGeneration when it could not be read either.
+func getCachedPage(condition SearchCondition, inferred map[string]string) (encodedPage, int64, bool) {
+	suffix, err := pageCacheSuffix(condition, inferred)
+	if err != nil {
+		return encodedPage{}, unknownGeneration, false
+	}
+	result, err := cachedPageScript.Run(context.Background(), redisClient, []string{cacheGenerationKey}, cachePagePrefix, suffix).Slice()
+	if err != nil || len(result) != 2 {
+		return encodedPage{}, unknownGeneration, false
+	}
+	generationStr, _ := result[0].(string)
+	generation, err := strconv.ParseInt(generationStr, 10, 64)
+	if err != nil {
+		return encodedPage{}, unknownGeneration, false
+	}
+
+	//HGETALL replies field, value pairs
+	pairs, _ := result[1].([]interface{})
+	fields := map[string]string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		field, _ := pairs[i].(string)
+		value, _ := pairs[i+1].(string)
+		fields[field] = value
+	}
+	if fields["body"] == "" {
+		return encodedPage{}, generation, false
+	}
+	expireAt, err := strconv.ParseInt(fields["expireAt"], 10, 64)
+	if err != nil {
+		return encodedPage{}, generation, false
+	}
+	return encodedPage{
+		body:     []byte(fields["body"]),
+		gzipBody: []byte(fields["gzip"]),
+		etag:     fields["etag"],
+		expireAt: time.UnixMilli(expireAt),
+	}, generation, true
+}
+
+// Store page with its compressed form until its results expire, pages with per request counters are not stored
+func saveCachedPage(condition SearchCondition, inferred map[string]string, generation int64, page *encodedPage) {
+	if page.volatile || !page.expireAt.After(getNowTime()) {
+		return
+	}
+	key, err := pageCacheKey(condition, inferred, generation)
+	if err != nil {
+		return
+	}
+	page.compress()
+	ctx := context.Background()
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, key, "body", page.body, "gzip", page.gzipBody, "etag", page.etag, "expireAt", page.expireAt.UnixMilli())
+	pipe.PExpireAt(ctx, key, page.expireAt)
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		println("Cannot cache page: ", err.Error())
+	}
+}
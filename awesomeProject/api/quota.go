@@ -0,0 +1,105 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Business rule from the assignment, can be overridden by environment
+var maxActiveAds = getEnvInt("AD_MAX_ACTIVE_ADS", 3000)
+var maxDailyCreatedAds = getEnvInt("AD_MAX_DAILY_CREATED_ADS", 3000)
+
+// Every writer takes the same advisory lock, so concurrent admin requests cannot both pass the check
+const adQuotaLockKey = 3000
+
+// Returned when saving an ad would break one of the quotas
+type quotaError struct {
+	limit string
+	max   int
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("%s limit reached (max %d)", e.limit, e.max)
+}
+
+func checkAdQuota(tx *sql.Tx, ad Ad, now time.Time) error {
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", adQuotaLockKey)
+	if err != nil {
+		return err
+	}
+
+	//Ads created since UTC midnight
+	var createdToday int
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	err = tx.QueryRow("SELECT COUNT(*) FROM ad WHERE created_at >= $1", today).Scan(&createdToday)
+	if err != nil {
+		return err
+	}
+	if createdToday >= maxDailyCreatedAds {
+		return &quotaError{limit: "daily created ad", max: maxDailyCreatedAds}
+	}
+
+	//Ads overlapping new ad's [startAt, endAt]
+	rows, err := tx.Query("SELECT start_at, end_at FROM ad WHERE start_at <= $2 AND end_at >= $1", ad.StartAt, ad.EndAt)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var intervals [][2]time.Time
+	for rows.Next() {
+		var interval [2]time.Time
+		err = rows.Scan(&interval[0], &interval[1])
+		if err != nil {
+			return err
+		}
+		intervals = append(intervals, interval)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	if peakConcurrentAds(intervals, ad.StartAt, ad.EndAt) >= maxActiveAds {
+		return &quotaError{limit: "active ad", max: maxActiveAds}
+	}
+
+	return nil
+}
+
+// Max number of intervals active at the same moment inside [start, end], both ends inclusive
+func peakConcurrentAds(intervals [][2]time.Time, start time.Time, end time.Time) int {
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	var events []event
+	for _, interval := range intervals {
+		if interval[0].After(end) || interval[1].Before(start) {
+			continue
+		}
+		from := interval[0]
+		if from.Before(start) {
+			from = start
+		}
+		events = append(events, event{at: from, delta: 1}, event{at: interval[1], delta: -1})
+	}
+
+	//End time is inclusive, so at the same moment starts are counted before ends
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].at.Equal(events[j].at) {
+			return events[i].delta > events[j].delta
+		}
+		return events[i].at.Before(events[j].at)
+	})
+
+	peak := 0
+	active := 0
+	for _, e := range events {
+		active += e.delta
+		if active > peak {
+			peak = active
+		}
+	}
+	return peak
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// Ranking strategy compares two candidate ads, seed is the requesting user.
+// Every strategy ends with uuid as tie breaker, cursors need a strict total order to seek in.
+type rankingLess func(a Ad, b Ad, seed string) bool
+
+// Candidates come from cache and database ordered by endAt
+const defaultRanking = "endAt"
+
+// Highest priority (bid) an ad can have
+const maxPriority = 10000
+
+var rankingStrategies = map[string]rankingLess{
+	//Ads ending soonest first
+	"endAt": func(a Ad, b Ad, seed string) bool {
+		return adBefore(a.EndAt, a.UUID, b)
+	},
+	//Ads started most recently first
+	"newest": func(a Ad, b Ad, seed string) bool {
+		if a.StartAt.Equal(b.StartAt) {
+			return a.UUID < b.UUID
+		}
+		return a.StartAt.After(b.StartAt)
+	},
+	//Same user always sees the same order, different users see different ones
+	"shuffle": func(a Ad, b Ad, seed string) bool {
+		hashA := shuffleHash(seed, a.UUID)
+		hashB := shuffleHash(seed, b.UUID)
+		if hashA == hashB {
+			return a.UUID < b.UUID
+		}
+		return hashA < hashB
+	},
+	//Highest bid first, like the ranking of a second-price auction
+	"priority": func(a Ad, b Ad, seed string) bool {
+		if a.Priority == b.Priority {
+			return adBefore(a.EndAt, a.UUID, b)
+		}
+		return a.Priority > b.Priority
+	},
+	//Weighted random sampling without replacement, an ad is picked first with chance proportional to priority+1.
+	//Key of Efraimidis-Spirakis, ads with priority 0 still get shown.
+	"weighted": func(a Ad, b Ad, seed string) bool {
+		keyA := weightedKey(seed, a)
+		keyB := weightedKey(seed, b)
+		if keyA == keyB {
+			return a.UUID < b.UUID
+		}
+		return keyA < keyB
+	},
+}
+
+// Strategies giving a different order on every request
+var randomRankings = map[string]bool{
+	"weighted": true,
+}
+
+func newRandomSeed() string {
+	seed := make([]byte, 8)
+	rand.Read(seed)
+	return hex.EncodeToString(seed)
+}
+
+func weightedKey(seed string, ad Ad) float64 {
+	//Uniform in (0, 1)
+	u := (float64(shuffleHash(seed, ad.UUID)>>11) + 0.5) / (1 << 53)
+	return -math.Log(u) / float64(ad.Priority+1)
+}
+
+func isValidRanking(name string) bool {
+	_, ok := rankingStrategies[name]
+	return ok
+}
+
+func shuffleHash(seed string, id string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(seed))
+	hash.Write([]byte{0})
+	hash.Write([]byte(id))
+	return hash.Sum64()
+}
+
+// Order candidates by strategy, cached candidate slice is never modified
+func rankAds(ads []Ad, name string, seed string) []Ad {
+	if name == defaultRanking {
+		return ads
+	}
+	less := rankingStrategies[name]
+	ranked := make([]Ad, len(ads))
+	copy(ranked, ads)
+	sort.Slice(ranked, func(i, j int) bool {
+		return less(ranked[i], ranked[j], seed)
+	})
+	return ranked
+}
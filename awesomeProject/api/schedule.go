@@ -0,0 +1,157 @@
+package api
+
+import (
+	"errors"
+	"sync"
+	"time"
+	_ "time/tzdata"
+)
+
+// Loaded timezones, schedules are checked on every request
+var locations sync.Map
+
+func loadLocation(name string) (*time.Location, error) {
+	if location, ok := locations.Load(name); ok {
+		return location.(*time.Location), nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, location)
+	return location, nil
+}
+
+var scheduleDays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+// Minutes since midnight of "HH:MM", "24:00" is the end of day
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+	return 0, errors.New("time must be HH:MM")
+}
+
+func (s AdSchedule) isEmpty() bool {
+	return len(s.Days) == 0 && len(s.Hours) == 0
+}
+
+func validateSchedule(s AdSchedule) error {
+	if s.isEmpty() {
+		return nil
+	}
+	if s.Timezone == "" {
+		return errors.New("schedule timezone cannot be empty")
+	}
+	if _, err := loadLocation(s.Timezone); err != nil {
+		return errors.New("schedule timezone is not an IANA timezone")
+	}
+	for _, day := range s.Days {
+		if _, ok := scheduleDays[day]; !ok {
+			return errors.New("schedule days can only be Mon, Tue, Wed, Thu, Fri, Sat or Sun")
+		}
+	}
+	for _, hours := range s.Hours {
+		start, err := parseClock(hours.Start)
+		if err != nil {
+			return errors.New("schedule hours start: " + err.Error())
+		}
+		end, err := parseClock(hours.End)
+		if err != nil {
+			return errors.New("schedule hours end: " + err.Error())
+		}
+		if start >= end {
+			return errors.New("schedule hours start must be before end, split ranges crossing midnight")
+		}
+	}
+	return nil
+}
+
+// Schedule windows of a local day, an empty hours list is the whole day
+func (s AdSchedule) windowsOfDay(day time.Time) [][2]time.Time {
+	if len(s.Days) > 0 {
+		allowed := false
+		for _, name := range s.Days {
+			if scheduleDays[name] == day.Weekday() {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return nil
+		}
+	}
+	if len(s.Hours) == 0 {
+		return [][2]time.Time{{day, day.AddDate(0, 0, 1)}}
+	}
+	var windows [][2]time.Time
+	for _, hours := range s.Hours {
+		start, _ := parseClock(hours.Start)
+		end, _ := parseClock(hours.End)
+		windows = append(windows, [2]time.Time{clockOnDay(day, start), clockOnDay(day, end)})
+	}
+	return windows
+}
+
+// Wall clock on a local day, daylight saving gaps resolve like time.Date does
+func clockOnDay(day time.Time, minutes int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, minutes, 0, 0, day.Location())
+}
+
+// Whether ad is inside its schedule at now, and the next window boundary after now.
+// Boundary is zero for ads without schedule, touching windows give a boundary where nothing changes which only costs a cache refresh.
+func (s AdSchedule) activeAt(now time.Time) (bool, time.Time) {
+	if s.isEmpty() {
+		return true, time.Time{}
+	}
+	location, err := loadLocation(s.Timezone)
+	if err != nil {
+		return false, time.Time{}
+	}
+	local := now.In(location)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+
+	active := false
+	var next time.Time
+	//Yesterday for windows still open, a week ahead for the next one
+	for offset := -1; offset <= 8; offset++ {
+		for _, window := range s.windowsOfDay(today.AddDate(0, 0, offset)) {
+			if !window[0].After(now) && window[1].After(now) {
+				active = true
+			}
+			for _, boundary := range window {
+				if boundary.After(now) && (next.IsZero() || boundary.Before(next)) {
+					next = boundary
+				}
+			}
+		}
+	}
+	return active, next
+}
+
+// Ads inside their schedule at now, and the earliest boundary where any of them can enter or leave it
+func applySchedules(ads []Ad, now time.Time) ([]Ad, time.Time) {
+	var result = []Ad{}
+	var next time.Time
+	for _, ad := range ads {
+		active, change := ad.Schedule.activeAt(now)
+		if !change.IsZero() && (next.IsZero() || change.Before(next)) {
+			next = change
+		}
+		if active {
+			result = append(result, ad)
+		}
+	}
+	return result, next
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Placements one batch search can resolve
+const maxSearchPlacements = 20
+
+// Request body of POST /api/v1/ad/search, either one search or a batch of placements
+type searchBody struct {
+	searchRequest
+	Placements []searchPlacement `json:"placements"`
+}
+
+// One slot of a page, id is echoed back with its results
+type searchPlacement struct {
+	ID string `json:"id"`
+	searchRequest
+}
+
+// Results of one placement
+type PlacementResponse struct {
+	ID string `json:"id"`
+	SearchResponse
+}
+
+// Response of batch search, placements are in request order
+type BatchSearchResponse struct {
+	Placements []PlacementResponse `json:"placements"`
+}
+
+// Conditions of every placement, any invalid placement fails the whole batch
+func validatePlacements(placements []searchPlacement) ([]SearchCondition, error) {
+	if len(placements) > maxSearchPlacements {
+		return nil, fmt.Errorf("at most %d placements", maxSearchPlacements)
+	}
+	seen := map[string]bool{}
+	var conditions []SearchCondition
+	for i, placement := range placements {
+		if placement.ID == "" || seen[placement.ID] {
+			return nil, fmt.Errorf("placements[%d]: id must be unique and not empty", i)
+		}
+		seen[placement.ID] = true
+		condition, err := validateSearchRequest(placement.searchRequest)
+		if err != nil {
+			return nil, fmt.Errorf("placements[%d]: %s", i, err.Error())
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// Handles POST /api/v1/ad/search, same search as GET /api/v1/ad with conditions in JSON body.
+// A body with placements resolves each of them and returns per placement results, an ad fills at most one placement.
+func searchAPI(w http.ResponseWriter, r *http.Request) {
+	var body searchBody
+	err := newJSONDecoder(r, http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		http.Error(w, "Failed to decode JSON request body "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if body.Placements == nil {
+		condition, err := validateSearchRequest(body.searchRequest)
+		if err != nil {
+			http.Error(w, "Invalid param: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := searchWithInference(r, condition)
+		if err != nil {
+			http.Error(w, "Invalid condition: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if len(body.Placements) == 0 {
+		http.Error(w, "Invalid param: placements cannot be empty", http.StatusBadRequest)
+		return
+	}
+	conditions, err := validatePlacements(body.Placements)
+	if err != nil {
+		http.Error(w, "Invalid param: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	//Every placement is resolved before any is served, a failed batch charges nothing
+	now := getNowTime()
+	var pages []*searchPage
+	served := map[string]bool{}
+	for i, condition := range conditions {
+		var inferred map[string]string
+		if condition.Infer {
+			inferred = inferSearchCondition(r, &condition)
+		}
+		page, err := findSearchPage(condition, unknownGeneration, served, now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid condition: placements[%d]: %s", i, err.Error()), http.StatusBadRequest)
+			return
+		}
+		for _, ad := range page.ads {
+			served[ad.UUID] = true
+		}
+		page.response.Inferred = inferred
+		pages = append(pages, &page)
+	}
+	serveSearchPages(pages, now)
+
+	var batch = BatchSearchResponse{Placements: []PlacementResponse{}}
+	for i, page := range pages {
+		batch.Placements = append(batch.Placements, PlacementResponse{ID: body.Placements[i].ID, SearchResponse: page.response})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// Search with opt-in inference of missing country and platform
+func searchWithInference(r *http.Request, condition SearchCondition) (SearchResponse, error) {
+	var inferred map[string]string
+	if condition.Infer {
+		inferred = inferSearchCondition(r, &condition)
+	}
+	response, err := getAdsByConditions(condition, unknownGeneration)
+	if err != nil {
+		return response, err
+	}
+	response.Inferred = inferred
+	return response, nil
+}
@@ -0,0 +1,347 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Built-in targeting dimension.
+// Values keep their own fields in AdCondition, SearchCondition and searchRequest and their own columns,
+// so existing clients and stored ads are unchanged. Validation, SQL matching and the serving index only go through builtinDimensions.
+type builtinDimension struct {
+	//Query param and request field name
+	name string
+	//Name in error messages
+	label string
+	//Values an ad targets, none means every value
+	adValues func(c AdCondition) []string
+	//Values an ad excludes, nil when the dimension has no exclusions
+	excluded func(c AdCondition) []string
+	//Values a request asks for, any of them matches
+	queryValues func(c *SearchCondition) *[]string
+	//Request value in stored form, false when invalid
+	parseQuery func(value string) (string, bool)
+	//Checks one targeted or excluded value of an ad, nil when values are checked elsewhere like age ranges
+	validAdValue func(value string) bool
+	//Rest of the error of an invalid ad value after its label
+	invalidAdValue string
+	//SQL condition of ads matching one request value
+	sqlMatch func(value string) string
+}
+
+var builtinDimensions = []builtinDimension{
+	{
+		name:        "age",
+		label:       "Age",
+		adValues:    func(c AdCondition) []string { return ageValues(c) },
+		queryValues: func(c *SearchCondition) *[]string { return &c.Age },
+		parseQuery: func(value string) (string, bool) {
+			age, err := strconv.Atoi(value)
+			return value, err == nil && age >= minAge && age <= maxAge
+		},
+		sqlMatch: func(value string) string { return strings.ReplaceAll(ageRangeQuery, "$age", value) },
+	},
+	{
+		name:           "gender",
+		label:          "Gender",
+		adValues:       func(c AdCondition) []string { return c.Gender },
+		queryValues:    func(c *SearchCondition) *[]string { return &c.Gender },
+		parseQuery:     func(value string) (string, bool) { return value, isValidGender(value) },
+		validAdValue:   isValidGender,
+		invalidAdValue: "can only be M or F",
+		sqlMatch:       jsonColumnMatch("Gender", ""),
+	},
+	{
+		name:           "country",
+		label:          "Country",
+		adValues:       func(c AdCondition) []string { return c.Countries },
+		excluded:       func(c AdCondition) []string { return c.ExcludeCountries },
+		queryValues:    func(c *SearchCondition) *[]string { return &c.Country },
+		parseQuery:     normalizeCountry,
+		validAdValue:   isISO3166,
+		invalidAdValue: "not in ISO3166",
+		sqlMatch:       jsonColumnMatch("Country", "exclude_country"),
+	},
+	{
+		name:           "platform",
+		label:          "Platform",
+		adValues:       func(c AdCondition) []string { return c.Platforms },
+		excluded:       func(c AdCondition) []string { return c.ExcludePlatforms },
+		queryValues:    func(c *SearchCondition) *[]string { return &c.Platform },
+		parseQuery:     func(value string) (string, bool) { return value, isValidPlatform(value) },
+		validAdValue:   isValidPlatform,
+		invalidAdValue: "can only be android or web or ios",
+		sqlMatch:       jsonColumnMatch("Platform", "exclude_platform"),
+	},
+}
+
+// Column holds a JSON array of targeted values or null for every value, excludeColumn one of excluded values.
+// Values are validated before they reach SQL.
+func jsonColumnMatch(column string, excludeColumn string) func(value string) string {
+	return func(value string) string {
+		match := "(" + column + " LIKE '%null%' OR " + column + " LIKE '%\"" + value + "\"%')"
+		if excludeColumn != "" {
+			match += " AND " + excludeColumn + " NOT LIKE '%\"" + value + "\"%'"
+		}
+		return "(" + match + ")"
+	}
+}
+
+// Targeted and excluded values of an ad for every built-in dimension
+func validateBuiltinDimensions(c AdCondition) error {
+	for _, dimension := range builtinDimensions {
+		if dimension.validAdValue == nil {
+			continue
+		}
+		for _, value := range dimension.adValues(c) {
+			if !dimension.validAdValue(value) {
+				return errors.New(dimension.label + " " + dimension.invalidAdValue)
+			}
+		}
+		if dimension.excluded == nil {
+			continue
+		}
+		for _, value := range dimension.excluded(c) {
+			if !dimension.validAdValue(value) {
+				return errors.New("Excluded " + dimension.name + " " + dimension.invalidAdValue)
+			}
+			if contains(dimension.adValues(c), value) {
+				return errors.New(dimension.label + " " + value + " is both included and excluded")
+			}
+		}
+	}
+	return nil
+}
+
+// Targeting dimension beyond the built-in fields.
+// Ads list their values in conditions.targeting under the dimension name, requests send query params of the same name.
+// Adding such a dimension only needs an entry in targetingDimensions.
+type targetingDimension struct {
+	//Checks one value of an ad
+	validateAdValue func(value string) error
+	//Checks one value of a request
+	validateQueryValue func(value string) error
+	//Form values are stored and compared in
+	normalize func(value string) string
+	//Whether ad values accept request values, both are non-empty
+	match func(adValues []string, queryValues []string) bool
+}
+
+var targetingDimensions = map[string]targetingDimension{
+	"language":   enumDimension(strings.Fields(iso639)),
+	"appVersion": semverDimension(),
+	"osVersion":  semverDimension(),
+	"tag":        tagDimension(),
+}
+
+// ISO 639-1 language codes
+const iso639 = "aa ab ae af ak am an ar as av ay az ba be bg bh bi bm bn bo br bs ca ce ch co cr cs cu cv cy da de dv dz ee el en eo es et eu fa ff fi fj fo fr fy ga gd gl gn gu gv ha he hi ho hr ht hu hy hz ia id ie ig ii ik io is it iu ja jv ka kg ki kj kk kl km kn ko kr ks ku kv kw ky la lb lg li ln lo lt lu lv mg mh mi mk ml mn mr ms mt my na nb nd ne ng nl nn no nr nv ny oc oj om or os pa pi pl ps pt qu rm rn ro ru rw sa sc sd se sg si sk sl sm sn so sq sr ss st su sv sw ta te tg th ti tk tl tn to tr ts tt tw ty ug uk ur uz ve vi vo wa wo xh yi yo za zh zu"
+
+// Ad targets a set of values, request matches when it has any of them
+func enumDimension(values []string) targetingDimension {
+	valid := map[string]bool{}
+	for _, value := range values {
+		valid[value] = true
+	}
+	check := func(value string) error {
+		if !valid[strings.ToLower(value)] {
+			return errors.New("unknown value " + value)
+		}
+		return nil
+	}
+	return targetingDimension{
+		validateAdValue:    check,
+		validateQueryValue: check,
+		normalize:          strings.ToLower,
+		match: func(adValues []string, queryValues []string) bool {
+			for _, value := range queryValues {
+				if contains(adValues, value) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// Ad targets version constraints like ">=5.2" and "<6", request sends a version and matches when it meets all of them
+func semverDimension() targetingDimension {
+	return targetingDimension{
+		validateAdValue: func(value string) error {
+			_, _, err := parseVersionConstraint(value)
+			return err
+		},
+		validateQueryValue: func(value string) error {
+			_, err := parseVersion(value)
+			return err
+		},
+		normalize: strings.TrimSpace,
+		match: func(adValues []string, queryValues []string) bool {
+			for _, value := range queryValues {
+				version, _ := parseVersion(value)
+				matched := true
+				for _, constraint := range adValues {
+					op, target, _ := parseVersionConstraint(constraint)
+					if !compareVersions(version, target, op) {
+						matched = false
+					}
+				}
+				if matched {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// Ad targets "key=value" tags, request matches when for every key the ad targets it has one of the ad's values or no value at all
+func tagDimension() targetingDimension {
+	check := func(value string) error {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || len(value) > 64 {
+			return errors.New("tag must be key=value")
+		}
+		return nil
+	}
+	return targetingDimension{
+		validateAdValue:    check,
+		validateQueryValue: check,
+		normalize:          strings.ToLower,
+		match: func(adValues []string, queryValues []string) bool {
+			wanted := map[string][]string{}
+			for _, value := range adValues {
+				parts := strings.SplitN(value, "=", 2)
+				wanted[parts[0]] = append(wanted[parts[0]], value)
+			}
+			for key, values := range wanted {
+				known := false
+				found := false
+				for _, value := range queryValues {
+					if strings.HasPrefix(value, key+"=") {
+						known = true
+						found = found || contains(values, value)
+					}
+				}
+				if known && !found {
+					return false
+				}
+			}
+			return true
+		},
+	}
+}
+
+// Numeric parts of "major.minor.patch", missing parts are 0
+func parseVersion(value string) ([3]int, error) {
+	var version [3]int
+	parts := strings.Split(strings.TrimPrefix(strings.TrimSpace(value), "v"), ".")
+	if len(parts) > 3 {
+		return version, errors.New("invalid version " + value)
+	}
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return version, errors.New("invalid version " + value)
+		}
+		version[i] = number
+	}
+	return version, nil
+}
+
+func parseVersionConstraint(value string) (string, [3]int, error) {
+	value = strings.TrimSpace(value)
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(value, op) {
+			version, err := parseVersion(value[len(op):])
+			return op, version, err
+		}
+	}
+	version, err := parseVersion(value)
+	return "=", version, err
+}
+
+func compareVersions(version [3]int, target [3]int, op string) bool {
+	cmp := 0
+	for i := range version {
+		if version[i] != target[i] {
+			if version[i] < target[i] {
+				cmp = -1
+			} else {
+				cmp = 1
+			}
+			break
+		}
+	}
+	switch op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp == 0
+	}
+}
+
+func validateTargeting(targeting map[string][]string, isQuery bool) error {
+	for name, values := range targeting {
+		dimension, ok := targetingDimensions[name]
+		if !ok {
+			return errors.New("unknown targeting dimension " + name)
+		}
+		for _, value := range values {
+			validate := dimension.validateAdValue
+			if isQuery {
+				validate = dimension.validateQueryValue
+			}
+			if err := validate(value); err != nil {
+				return errors.New(name + ": " + err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Stored form of targeting, empty dimensions are dropped
+func normalizeTargeting(targeting map[string][]string) map[string][]string {
+	var normalized = map[string][]string{}
+	for name, values := range targeting {
+		dimension := targetingDimensions[name]
+		for _, value := range values {
+			normalized[name] = append(normalized[name], dimension.normalize(value))
+		}
+	}
+	return normalized
+}
+
+// Whether ad accepts request, dimensions missing on either side do not restrict
+func matchTargeting(adTargeting map[string][]string, queryTargeting map[string][]string) bool {
+	for name, queryValues := range queryTargeting {
+		adValues := adTargeting[name]
+		if len(adValues) == 0 || len(queryValues) == 0 {
+			continue
+		}
+		if !targetingDimensions[name].match(adValues, queryValues) {
+			return false
+		}
+	}
+	return true
+}
+
+func filterTargeting(ads []Ad, queryTargeting map[string][]string) []Ad {
+	if len(queryTargeting) == 0 {
+		return ads
+	}
+	var result = []Ad{}
+	for _, ad := range ads {
+		if matchTargeting(ad.Conditions.Targeting, queryTargeting) {
+			result = append(result, ad)
+		}
+	}
+	return result
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Tracking events
+const (
+	impressionEvent = "impression"
+	clickEvent      = "click"
+)
+
+// Tokens stay valid for a while after the ad ends, late clicks still count
+const trackingTokenGrace = 24 * time.Hour
+
+var statsFlushInterval = time.Duration(getEnvInt("AD_STATS_FLUSH_MS", 5000)) * time.Millisecond
+
+const statsBufferSize = 100000
+const statsBatchSize = 1000
+
+// Response header of anonymous pages, sent back with their shared tracking tokens
+const serveTokenHeader = "X-Serve-Token"
+
+// Payload of tracking token returned with each search result
+type trackingToken struct {
+	AdID     string `json:"a"`
+	UserID   string `json:"u,omitempty"`
+	Nonce    string `json:"n,omitempty"`
+	ExpireAt int64  `json:"x"`
+}
+
+// Payload of serve token, one per anonymous page written
+type serveToken struct {
+	Nonce    string `json:"n"`
+	ExpireAt int64  `json:"x"`
+}
+
+// Single use token, each serve gets its own nonce
+func newTrackingToken(ad Ad, userID string) string {
+	token := trackingToken{AdID: ad.UUID, UserID: userID, Nonce: newRandomSeed(), ExpireAt: ad.EndAt.Add(trackingTokenGrace).Unix()}
+	payload, _ := json.Marshal(token)
+	return signToken(payload)
+}
+
+// Token of anonymous pages, the same for every request so pages stay cacheable.
+// Its events are counted once per serve token sent with the page.
+func newSharedTrackingToken(ad Ad) string {
+	token := trackingToken{AdID: ad.UUID, ExpireAt: ad.EndAt.Add(trackingTokenGrace).Unix()}
+	payload, _ := json.Marshal(token)
+	return signToken(payload)
+}
+
+// Signed when the page is written, cached pages get a new one per request
+func newServeToken(now time.Time) string {
+	payload, _ := json.Marshal(serveToken{Nonce: newRandomSeed(), ExpireAt: now.Add(trackingTokenGrace).Unix()})
+	return signToken(payload)
+}
+
+func parseServeToken(value string, now time.Time) (serveToken, error) {
+	var token serveToken
+	payload, err := verifyToken(value)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(payload, &token)
+	if err != nil || token.Nonce == "" {
+		return token, errors.New("malformed serve token")
+	}
+	if now.Unix() > token.ExpireAt {
+		return token, errors.New("serve token expired")
+	}
+	return token, nil
+}
+
+// Whether event of token should be counted, each nonce counts once per ad and event until the token expires.
+// Shared tokens take the nonce of the serve token of their page.
+// Without Redis events are counted, like counters of other features.
+func allowTrackingEvent(token trackingToken, serveStr string, event string, now time.Time) (bool, error) {
+	nonce := token.Nonce
+	if nonce == "" {
+		if serveStr == "" {
+			return false, errors.New("serve token is required with shared tokens")
+		}
+		serve, err := parseServeToken(serveStr, now)
+		if err != nil {
+			return false, err
+		}
+		nonce = serve.Nonce
+	}
+
+	//Zero expiration would keep the key forever
+	ttl := max(time.Unix(token.ExpireAt, 0).Sub(now), time.Second)
+	key := fmt.Sprintf("ad:track:%s:%s:%s", nonce, token.AdID, event)
+	first, err := redisClient.SetNX(context.Background(), key, 1, ttl).Result()
+	if err != nil {
+		println("Cannot check tracking nonce: ", err.Error())
+		return true, nil
+	}
+	return first, nil
+}
+
+func parseTrackingToken(value string, adID string, now time.Time) (trackingToken, error) {
+	var token trackingToken
+	payload, err := verifyToken(value)
+	if err != nil {
+		return token, err
+	}
+	err = json.Unmarshal(payload, &token)
+	if err != nil {
+		return token, errors.New("malformed token")
+	}
+	if token.AdID != adID {
+		return token, errors.New("token is for another ad")
+	}
+	if now.Unix() > token.ExpireAt {
+		return token, errors.New("token expired")
+	}
+	return token, nil
+}
+
+type statsEvent struct {
+	adID  string
+	day   time.Time
+	event string
+}
+
+type statsKey struct {
+	adID string
+	day  time.Time
+}
+
+type statsCount struct {
+	impressions int64
+	clicks      int64
+}
+
+// Events wait here for the next batched write
+var statsEvents = make(chan statsEvent, statsBufferSize)
+
+// Queue event without blocking the request, events are dropped when buffer is full
+func recordStatsEvent(adID string, event string, now time.Time) bool {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	select {
+	case statsEvents <- statsEvent{adID: adID, day: day, event: event}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Aggregate queued events and write them in batches until process exits
+func runStatsWriter(interval time.Duration) {
+	pending := map[statsKey]*statsCount{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-statsEvents:
+			key := statsKey{adID: e.adID, day: e.day}
+			if pending[key] == nil {
+				pending[key] = &statsCount{}
+			}
+			if e.event == clickEvent {
+				pending[key].clicks++
+			} else {
+				pending[key].impressions++
+			}
+			if len(pending) < statsBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if len(pending) == 0 {
+			continue
+		}
+		err := saveStats(pending)
+		if err != nil {
+			//Keep counts and retry with next batch
+			log.Println("Cannot save ad stats: ", err)
+			continue
+		}
+		pending = map[statsKey]*statsCount{}
+	}
+}
+
+func saveStats(pending map[statsKey]*statsCount) error {
+	tx, err := dbClient.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := "INSERT INTO ad_stats (ad_uuid, day, impressions, clicks) VALUES ($1, $2, $3, $4) " +
+		"ON CONFLICT (ad_uuid, day) DO UPDATE SET impressions = ad_stats.impressions + EXCLUDED.impressions, clicks = ad_stats.clicks + EXCLUDED.clicks"
+	for key, count := range pending {
+		_, err = tx.Exec(query, key.adID, key.day, count.impressions, count.clicks)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// One row of admin report
+type AdStats struct {
+	AdID        string  `json:"adId"`
+	Day         string  `json:"day"`
+	Impressions int64   `json:"impressions"`
+	Clicks      int64   `json:"clicks"`
+	CTR         float64 `json:"ctr"`
+}
+
+func getAdStats(adID string, from time.Time, to time.Time) ([]AdStats, error) {
+	query := "SELECT ad_uuid, day, impressions, clicks FROM ad_stats WHERE day BETWEEN $1 AND $2"
+	args := []interface{}{from, to}
+	if adID != "" {
+		query += " AND ad_uuid = $3"
+		args = append(args, adID)
+	}
+	query += " ORDER BY ad_uuid, day"
+	rows, err := dbClient.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats = []AdStats{}
+	for rows.Next() {
+		var row AdStats
+		var day time.Time
+		err := rows.Scan(&row.AdID, &day, &row.Impressions, &row.Clicks)
+		if err != nil {
+			return nil, err
+		}
+		row.Day = day.Format("2006-01-02")
+		if row.Impressions > 0 {
+			row.CTR = float64(row.Clicks) / float64(row.Impressions)
+		}
+		stats = append(stats, row)
+	}
+	return stats, rows.Err()
+}
+
+// Handles POST /api/v1/ad/{id}/impression and /click, token and serve token come from query or JSON body
+func trackingAPI(event string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenStr := r.URL.Query().Get("token")
+		serveStr := r.URL.Query().Get("serve")
+		if tokenStr == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var body struct {
+				Token string `json:"token"`
+				Serve string `json:"serve"`
+			}
+			err := newJSONDecoder(r, http.MaxBytesReader(w, r.Body, 4096)).Decode(&body)
+			if err != nil {
+				http.Error(w, "Failed to decode JSON request body "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			tokenStr = body.Token
+			serveStr = body.Serve
+		}
+		if tokenStr == "" {
+			http.Error(w, "Token is required", http.StatusBadRequest)
+			return
+		}
+
+		now := getNowTime()
+		token, err := parseTrackingToken(tokenStr, mux.Vars(r)["id"], now)
+		if err != nil {
+			http.Error(w, "Invalid token: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		//Replayed single use tokens are accepted without being counted again, so clients can retry
+		allowed, err := allowTrackingEvent(token, serveStr, event, now)
+		if err != nil {
+			http.Error(w, "Invalid token: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !allowed {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		if !recordStatsEvent(mux.Vars(r)["id"], event, now) {
+			http.Error(w, "Too many events, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Handles GET /api/v1/report?adId=&from=&to=, dates are UTC days and default to last 7 days
+func reportAPI(w http.ResponseWriter, r *http.Request) {
+	now := getNowTime()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from := to.AddDate(0, 0, -6)
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		from, err = time.Parse("2006-01-02", value)
+		if err != nil {
+			http.Error(w, "Invalid param: From value is invalid", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		to, err = time.Parse("2006-01-02", value)
+		if err != nil {
+			http.Error(w, "Invalid param: To value is invalid", http.StatusBadRequest)
+			return
+		}
+	}
+	if from.After(to) {
+		http.Error(w, "Invalid param: from is after to", http.StatusBadRequest)
+		return
+	}
+
+	adID := r.URL.Query().Get("adId")
+	if _, err := uuid.Parse(adID); adID != "" && err != nil {
+		http.Error(w, "Invalid param: AdId value is invalid", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := getAdStats(adID, from, to)
+	if err != nil {
+		http.Error(w, "Database error "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": stats})
+}
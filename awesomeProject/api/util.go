@@ -1,8 +1,21 @@
 package api
 
-import "time"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 // Use same time zone as admin api
 func getNowTime() time.Time {
 	return time.Now().UTC()
 }
+
+// Read int setting from environment, fall back to default value
+func getEnvInt(name string, defaultVal int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultVal
+	}
+	return value
+}
@@ -2,17 +2,49 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Longest title in characters
+const maxTitleLength = 100
+
+// Ad rejected by validation, reported as bad request
+type invalidAdError struct {
+	err error
+}
+
+func (e *invalidAdError) Error() string {
+	return e.err.Error()
+}
+
+// Format characters emoji sequences are made of, zero width joiner of family emoji and tags of subdivision flags
+func emojiFormatChars(c rune) bool {
+	return c == '\u200d' || (c >= 0xe0020 && c <= 0xe007f)
+}
+
 func validateAd(ad Ad) error {
 	//Required fields
 	//Title is empty string
-	if ad.Title == "" {
+	if strings.TrimSpace(ad.Title) == "" {
 		return errors.New("ad title cannot be empty")
 	}
 
+	//Title too long or with control and invisible formatting characters
+	if utf8.RuneCountInString(ad.Title) > maxTitleLength {
+		return fmt.Errorf("ad title cannot be longer than %d characters", maxTitleLength)
+	}
+	for _, c := range ad.Title {
+		if unicode.IsControl(c) || (unicode.Is(unicode.Cf, c) && !emojiFormatChars(c)) || c == utf8.RuneError {
+			return errors.New("ad title contains invalid characters")
+		}
+	}
+
 	//startAt is empty
 	if ad.StartAt.IsZero() {
 		return errors.New("startAt cannot be empty")
@@ -29,6 +61,35 @@ func validateAd(ad Ad) error {
 	}
 
 	//Optional fields
+	//Priority out of range
+	if ad.Priority < 0 || ad.Priority > maxPriority {
+		return errors.New("priority must be between 0 and " + strconv.Itoa(maxPriority))
+	}
+
+	//Frequency cap out of range or unknown period
+	if ad.FrequencyCap.Max < 0 || ad.FrequencyCap.Max > maxFrequencyCap {
+		return errors.New("frequencyCap max must be between 0 and " + strconv.Itoa(maxFrequencyCap))
+	}
+	if ad.FrequencyCap.Period != "" && !frequencyCapPeriods[ad.FrequencyCap.Period] {
+		return errors.New("frequencyCap period can only be hour or day or week")
+	}
+
+	//Budget negative or unknown pacing
+	if ad.Budget.Total < 0 || ad.Budget.Daily < 0 {
+		return errors.New("budget cannot be negative")
+	}
+	if ad.Budget.Pacing != "" && !pacingModes[ad.Budget.Pacing] {
+		return errors.New("budget pacing can only be asap or even")
+	}
+	if ad.Budget.Pacing == "even" && !hasBudget(ad) {
+		return errors.New("even pacing needs a total or daily budget")
+	}
+
+	//Schedule
+	if err := validateSchedule(ad.Schedule); err != nil {
+		return err
+	}
+
 	//Missing one value
 	if (ad.Conditions.AgeStart == 0 && ad.Conditions.AgeEnd != 0) || (ad.Conditions.AgeStart != 0 && ad.Conditions.AgeEnd == 0) {
 		return errors.New("ageStart or ageEnd is missing")
@@ -49,96 +110,266 @@ func validateAd(ad Ad) error {
 		return errors.New("ageEnd > 100")
 	}
 
-	//Countries not in ISO-3166
-	if len(ad.Conditions.Countries) != 0 {
-		for _, country := range ad.Conditions.Countries {
-			if !isISO3166(country) {
-				return errors.New("Country not in ISO3166")
-			}
-		}
+	//Age ranges replace ageStart/ageEnd
+	if len(ad.Conditions.AgeRanges) > 0 && (ad.Conditions.AgeStart != 0 || ad.Conditions.AgeEnd != 0) {
+		return errors.New("use either ageRanges or ageStart/ageEnd")
+	}
+	if err := validateAgeRanges(ad.Conditions.AgeRanges); err != nil {
+		return err
 	}
 
-	//Gender not in [M,F]
-	if len(ad.Conditions.Gender) != 0 {
-		for _, gender := range ad.Conditions.Gender {
-			if !isValidGender(gender) {
-				return errors.New("Gender can only be M or F")
-			}
+	//Gender, countries and platforms, included and excluded
+	if err := validateBuiltinDimensions(ad.Conditions); err != nil {
+		return err
+	}
+
+	//Registered targeting dimensions
+	if err := validateTargeting(ad.Conditions.Targeting, false); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
 	}
+	return false
+}
 
-	//Platforms not in [android,ios,web]
-	if len(ad.Conditions.Platforms) != 0 {
-		for _, platform := range ad.Conditions.Platforms {
-			if !isValidPlatform(platform) {
-				return errors.New("Platform can only be android or web or ios")
-			}
+// Ages a public query can ask for
+const minAge = 1
+const maxAge = 100
+
+func validateAgeRanges(ranges []AgeRange) error {
+	for _, ageRange := range ranges {
+		if ageRange.Min == nil && ageRange.Max == nil {
+			return errors.New("age range needs min or max")
+		}
+		if ageRange.Min != nil && (*ageRange.Min < minAge || *ageRange.Min > maxAge) {
+			return errors.New("age range min must be between 1 and 100")
+		}
+		if ageRange.Max != nil && (*ageRange.Max < minAge || *ageRange.Max > maxAge) {
+			return errors.New("age range max must be between 1 and 100")
+		}
+		if ageRange.Min != nil && ageRange.Max != nil && *ageRange.Min > *ageRange.Max {
+			return errors.New("age range min > max")
 		}
 	}
 
+	//Overlapping ranges, checked in order of lower bound
+	sorted := append([]AgeRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].lower() < sorted[j].lower()
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].upper() >= sorted[i].lower() {
+			return errors.New("age ranges overlap")
+		}
+	}
 	return nil
 }
 
+// Bounds of range within valid ages
+func (r AgeRange) lower() int {
+	if r.Min == nil {
+		return minAge
+	}
+	return *r.Min
+}
+
+func (r AgeRange) upper() int {
+	if r.Max == nil {
+		return maxAge
+	}
+	return *r.Max
+}
+
+func (r AgeRange) contains(age int) bool {
+	return r.lower() <= age && age <= r.upper()
+}
+
+// Age ranges of condition, ads saved with ageStart/ageEnd have one range
+func (c AdCondition) ageRanges() []AgeRange {
+	if len(c.AgeRanges) > 0 {
+		return c.AgeRanges
+	}
+	if c.AgeStart == 0 && c.AgeEnd == 0 {
+		return nil
+	}
+	start, end := c.AgeStart, c.AgeEnd
+	return []AgeRange{{Min: &start, Max: &end}}
+}
+
+// Search request before validation, from query params of GET or JSON body of POST
+type searchRequest struct {
+	Offset   *int     `json:"offset"`
+	Limit    *int     `json:"limit"`
+	UserID   string   `json:"userId"`
+	DeviceID string   `json:"deviceId"`
+	Sort     string   `json:"sort"`
+	Cursor   string   `json:"cursor"`
+	Infer    bool     `json:"infer"`
+	Age      []int    `json:"age"`
+	Gender   []string `json:"gender"`
+	Country  []string `json:"country"`
+	Platform []string `json:"platform"`
+	//Values of registered targeting dimensions by name
+	Targeting map[string][]string `json:"targeting"`
+}
+
 func validateSearchParamAndAssignDefaultVal(r *http.Request) (SearchCondition, error) {
 
-	var condition SearchCondition
+	var request searchRequest
+	query := r.URL.Query()
 
 	//Single value params
-	offsetStr := r.URL.Query().Get("offset")
-	limitStr := r.URL.Query().Get("limit")
+	offsetStr := query.Get("offset")
+	limitStr := query.Get("limit")
 
 	if offsetStr != "" {
 		offset, err := strconv.Atoi(offsetStr)
-		if err != nil || offset < 0 {
+		if err != nil {
+			return SearchCondition{}, errors.New("Offset value is invalid")
+		}
+		request.Offset = &offset
+	}
+
+	if limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil {
+			return SearchCondition{}, errors.New("Limit value is invalid")
+		}
+		request.Limit = &limit
+	}
+
+	request.UserID = query.Get("userId")
+	request.DeviceID = query.Get("deviceId")
+	request.Sort = query.Get("sort")
+	request.Cursor = query.Get("cursor")
+
+	inferStr := query.Get("infer")
+	if inferStr != "" {
+		infer, err := strconv.ParseBool(inferStr)
+		if err != nil {
+			return SearchCondition{}, errors.New("Infer value is invalid")
+		}
+		request.Infer = infer
+	}
+
+	for _, ageStr := range query["age"] {
+		age, err := strconv.Atoi(ageStr)
+		if err != nil {
+			return SearchCondition{}, errors.New("Age value is invalid")
+		}
+		request.Age = append(request.Age, age)
+	}
+
+	//Multiple values params
+	request.Gender = query["gender"]
+	request.Country = query["country"]
+	request.Platform = query["platform"]
+
+	//Registered targeting dimensions, each param may repeat
+	for name := range targetingDimensions {
+		if values := query[name]; len(values) > 0 {
+			if request.Targeting == nil {
+				request.Targeting = map[string][]string{}
+			}
+			request.Targeting[name] = values
+		}
+	}
+
+	return validateSearchRequest(request)
+}
+
+// Checks search request and assigns default values, shared by query params and JSON body
+func validateSearchRequest(request searchRequest) (SearchCondition, error) {
+
+	var condition SearchCondition
+
+	if request.Offset != nil {
+		if *request.Offset < 0 {
 			return condition, errors.New("Offset value is invalid")
 		}
-		condition.Offset = offset
+		condition.Offset = *request.Offset
 	} else {
 		condition.Offset = 0
 	}
 
-	if limitStr != "" {
-		limit, err := strconv.Atoi(limitStr)
-		if err != nil || limit < 1 || limit > 100 {
+	if request.Limit != nil {
+		if *request.Limit < 1 || *request.Limit > 100 {
 			return condition, errors.New("Limit value is invalid")
 		}
-		condition.Limit = limit
+		condition.Limit = *request.Limit
 	} else {
 		condition.Limit = 5
 	}
 
-	for _, ageStr := range r.URL.Query()["age"] {
-		age, err := strconv.Atoi(ageStr)
-		if err != nil {
-			return condition, errors.New("Age value is invalid")
-		}
-		if age > 100 || age < 1 {
-			return condition, errors.New("Age value is invalid")
+	//Device id identifies anonymous users
+	condition.UserID = request.UserID
+	if condition.UserID == "" {
+		condition.UserID = request.DeviceID
+	}
+	if len(condition.UserID) > 128 {
+		return condition, errors.New("UserId value is invalid")
+	}
+
+	condition.Infer = request.Infer
+
+	if request.Sort != "" {
+		if !isValidRanking(request.Sort) {
+			return condition, errors.New("Sort value is invalid")
 		}
-		condition.Age = append(condition.Age, ageStr)
+		condition.Sort = request.Sort
+	} else {
+		condition.Sort = defaultRanking
 	}
 
-	//Multiple values params
-	for _, value := range r.URL.Query()["gender"] {
-		if !isValidGender(value) {
-			return condition, errors.New("Gender value is invalid")
+	//Cursor only seeks in the order it was issued for
+	if request.Cursor != "" {
+		cursor, err := decodeCursor(request.Cursor)
+		if err != nil || cursor.Sort != condition.Sort {
+			return condition, errors.New("Cursor value is invalid")
 		}
-		condition.Gender = append(condition.Gender, value)
+		condition.Cursor = &cursor
 	}
 
-	for _, value := range r.URL.Query()["country"] {
-		if !isISO3166(value) {
-			return condition, errors.New("Country value is invalid")
+	for _, age := range request.Age {
+		condition.Age = append(condition.Age, strconv.Itoa(age))
+	}
+	condition.Gender = append(condition.Gender, request.Gender...)
+	condition.Country = append(condition.Country, request.Country...)
+	condition.Platform = append(condition.Platform, request.Platform...)
+
+	//Built-in dimensions in stored form
+	for _, dimension := range builtinDimensions {
+		values := dimension.queryValues(&condition)
+		for i, value := range *values {
+			parsed, ok := dimension.parseQuery(value)
+			if !ok {
+				return condition, errors.New(dimension.label + " value is invalid")
+			}
+			(*values)[i] = parsed
 		}
-		condition.Country = append(condition.Country, value)
 	}
 
-	for _, value := range r.URL.Query()["platform"] {
-		if !isValidPlatform(value) {
-			return condition, errors.New("Platform value is invalid")
+	for name, values := range request.Targeting {
+		if len(values) == 0 {
+			continue
 		}
-		condition.Platform = append(condition.Platform, value)
+		if err := validateTargeting(map[string][]string{name: values}, true); err != nil {
+			return condition, errors.New("Targeting value is invalid, " + err.Error())
+		}
+		if condition.Targeting == nil {
+			condition.Targeting = map[string][]string{}
+		}
+		condition.Targeting[name] = values
 	}
+	condition.Targeting = normalizeTargeting(condition.Targeting)
 
 	return condition, nil
 }
@@ -160,9 +391,8 @@ func isValidPlatform(platform string) bool {
 	return validPlatform[platform]
 }
 
+// Stored form of a country, upper case alpha-2
 func isISO3166(country string) bool {
-	iso3166 := map[string]bool{
-		"AF": true, "AX": true, "AL": true, "DZ": true, "AS": true, "AD": true, "AO": true, "AI": true, "AQ": true, "AG": true, "AR": true, "AM": true, "AW": true, "AU": true, "AT": true, "AZ": true, "BS": true, "BH": true, "BD": true, "BB": true, "BY": true, "BE": true, "BZ": true, "BJ": true, "BM": true, "BT": true, "BO": true, "BQ": true, "BA": true, "BW": true, "BV": true, "BR": true, "IO": true, "BN": true, "BG": true, "BF": true, "BI": true, "CV": true, "KH": true, "CM": true, "CA": true, "KY": true, "CF": true, "TD": true, "CL": true, "CN": true, "CX": true, "CC": true, "CO": true, "KM": true, "CG": true, "CD": true, "CK": true, "CR": true, "CI": true, "HR": true, "CU": true, "CW": true, "CY": true, "CZ": true, "DK": true, "DJ": true, "DM": true, "DO": true, "EC": true, "EG": true, "SV": true, "GQ": true, "ER": true, "EE": true, "SZ": true, "ET": true, "FK": true, "FO": true, "FJ": true, "FI": true, "FR": true, "GF": true, "PF": true, "TF": true, "GA": true, "GM": true, "GE": true, "DE": true, "GH": true, "GI": true, "GR": true, "GL": true, "GD": true, "GP": true, "GU": true, "GT": true, "GG": true, "GN": true, "GW": true, "GY": true, "HT": true, "HM": true, "VA": true, "HN": true, "HK": true, "HU": true, "IS": true, "IN": true, "ID": true, "IR": true, "IQ": true, "IE": true, "IM": true, "IL": true, "IT": true, "JM": true, "JP": true, "JE": true, "JO": true, "KZ": true, "KE": true, "KI": true, "KP": true, "KR": true, "KW": true, "KG": true, "LA": true, "LV": true, "LB": true, "LS": true, "LR": true, "LY": true, "LI": true, "LT": true, "LU": true, "MO": true, "MK": true, "MG": true, "MW": true, "MY": true, "MV": true, "ML": true, "MT": true, "MH": true, "MQ": true, "MR": true, "MU": true, "YT": true, "MX": true, "FM": true, "MD": true, "MC": true, "MN": true, "ME": true, "MS": true, "MA": true, "MZ": true, "MM": true, "NA": true, "NR": true, "NP": true, "NL": true, "NC": true, "NZ": true, "NI": true, "NE": true, "NG": true, "NU": true, "NF": true, "MP": true, "NO": true, "OM": true, "PK": true, "PW": true, "PS": true, "PA": true, "PG": true, "PY": true, "PE": true, "PH": true, "PN": true, "PL": true, "PT": true, "PR": true, "QA": true, "RE": true, "RO": true, "RU": true, "RW": true, "BL": true, "SH": true, "KN": true, "LC": true, "MF": true, "PM": true, "VC": true, "WS": true, "SM": true, "ST": true, "SA": true, "SN": true, "RS": true, "SC": true, "SL": true, "SG": true, "SX": true, "SK": true, "SI": true, "SB": true, "SO": true, "ZA": true, "GS": true, "SS": true, "ES": true, "LK": true, "SD": true, "SR": true, "SJ": true, "SE": true, "CH": true, "SY": true, "TW": true, "TJ": true, "TZ": true, "TH": true, "TL": true, "TG": true, "TK": true, "TO": true, "TT": true, "TN": true, "TR": true, "TM": true, "TC": true, "TV": true, "UG": true, "UA": true, "AE": true, "GB": true, "US": true, "UM": true, "UY": true, "UZ": true, "VU": true, "VE": true, "VN": true, "VG": true, "VI": true, "WF": true, "EH": true, "YE": true, "ZM": true, "ZW": true,
-	}
-	return iso3166[country]
+	code, ok := countryCodes[country]
+	return ok && code == country
 }
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// v1 stays backward compatible until it is turned off at sunset
+var (
+	v1DeprecatedAt = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	v1SunsetAt     = time.Date(2027, 4, 19, 0, 0, 0, 0, time.UTC)
+)
+
+type apiVersionKey struct{}
+
+// Admin api v2 request, same as Ad with lowercase condition keys
+type AdV2 struct {
+	Title        string        `json:"title"`
+	StartAt      time.Time     `json:"startAt"`
+	EndAt        time.Time     `json:"endAt"`
+	Priority     int           `json:"priority"`
+	FrequencyCap FrequencyCap  `json:"frequencyCap"`
+	Budget       AdBudget      `json:"budget"`
+	Schedule     AdSchedule    `json:"schedule"`
+	Conditions   AdConditionV2 `json:"conditions"`
+}
+
+// Same fields as AdCondition, so the two convert into each other
+type AdConditionV2 struct {
+	AgeStart         int                 `json:"ageStart"`
+	AgeEnd           int                 `json:"ageEnd"`
+	AgeRanges        []AgeRange          `json:"ageRanges"`
+	Gender           []string            `json:"gender"`
+	Countries        []string            `json:"country"`
+	Platforms        []string            `json:"platform"`
+	ExcludeCountries []string            `json:"excludeCountry"`
+	ExcludePlatforms []string            `json:"excludePlatform"`
+	Targeting        map[string][]string `json:"targeting"`
+}
+
+func (ad AdV2) toAd() Ad {
+	return Ad{
+		Title:        ad.Title,
+		StartAt:      ad.StartAt,
+		EndAt:        ad.EndAt,
+		Priority:     ad.Priority,
+		FrequencyCap: ad.FrequencyCap,
+		Budget:       ad.Budget,
+		Schedule:     ad.Schedule,
+		Conditions:   AdCondition(ad.Conditions),
+	}
+}
+
+// Register handlers shared by every api version under its prefix
+func registerRoutes(r *mux.Router) {
+	r.HandleFunc("/ad", adminAPI).Methods("POST")
+	r.HandleFunc("/ad", publicAPI).Methods("GET")
+	r.HandleFunc("/ad/search", searchAPI).Methods("POST")
+	r.HandleFunc("/ad/{id}/impression", trackingAPI(impressionEvent)).Methods("POST")
+	r.HandleFunc("/ad/{id}/click", trackingAPI(clickEvent)).Methods("POST")
+	//Admin routes (POST /ad, /report, country groups) share the router with public ones, there is no separate admin listener.
+	//Like POST /ad, /report must be kept from public clients where the service is exposed.
+	r.HandleFunc("/report", reportAPI).Methods("GET")
+	r.HandleFunc("/country", listCountriesAPI).Methods("GET")
+	r.HandleFunc("/country-group", countryGroupAPI).Methods("POST")
+	r.HandleFunc("/country-group", listCountryGroupsAPI).Methods("GET")
+}
+
+// Marks v1 responses deprecated and points to the same path in v2
+func deprecateV1(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(v1DeprecatedAt.Unix(), 10))
+		w.Header().Set("Sunset", v1SunsetAt.Format(http.TimeFormat))
+		w.Header().Set("Link", "<"+strings.Replace(r.URL.Path, "/api/v1/", "/api/v2/", 1)+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Requests under v2 are decoded strictly
+func useV2(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, 2)))
+	})
+}
+
+func isV2(r *http.Request) bool {
+	return r.Context().Value(apiVersionKey{}) == 2
+}
+
+// JSON decoder of request body, v2 rejects fields the request type does not have
+func newJSONDecoder(r *http.Request, body io.Reader) *json.Decoder {
+	decoder := json.NewDecoder(body)
+	if isV2(r) {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder
+}
+
+// Admin request of either version as Ad, only v2 keys are case-sensitive
+func decodeAd(w http.ResponseWriter, r *http.Request) (Ad, error) {
+	if !isV2(r) {
+		var ad Ad
+		err := decodeStrictJSON(w, r, &ad, false)
+		return ad, err
+	}
+	var ad AdV2
+	err := decodeStrictJSON(w, r, &ad, true)
+	return ad.toAd(), err
+}
+
+// Query params of GET search are the JSON names of searchRequest, targeting values come as params named by dimension
+var searchParams = func() map[string]bool {
+	params := map[string]bool{}
+	for name := range jsonFields(reflect.TypeOf(searchRequest{})) {
+		params[name] = name != "targeting"
+	}
+	return params
+}()
+
+// v2 rejects query params the search does not know
+func checkSearchParams(r *http.Request) error {
+	if !isV2(r) {
+		return nil
+	}
+	for name := range r.URL.Query() {
+		if _, ok := targetingDimensions[name]; !searchParams[name] && !ok {
+			return errors.New("unknown param " + name)
+		}
+	}
+	return nil
+}
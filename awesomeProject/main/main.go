@@ -1,8 +1,17 @@
 package main
 
-import "awesomeProject/api"
+import (
+	"awesomeProject/api"
+	"os"
+)
 
 func main() {
+	//Load test, e.g. main loadtest -ads 3000 -rps 10000
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		api.LoadTest(os.Args[2:])
+		return
+	}
+
 	//Entry point
 	api.Main()
 }